@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TestFormats saves the 64x64 image after 100 turns in each pattern format, and checks that
+// reading it back into a bigger world gives the same cells.
+func TestFormats(t *testing.T) {
+	expected := readAliveCells("check/images/64x64x100.pgm", 64, 64)
+	for _, format := range []string{gol.RleFormat, gol.CellsFormat, gol.LifeFormat, gol.MacrocellFormat} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			p := gol.Params{ImageWidth: 64, ImageHeight: 64, Turns: 100, Threads: 4, Format: format, OutputDir: dir}
+			assertEqualBoard(t, finalAliveCells(p), expected, p)
+
+			p = gol.Params{ImageWidth: 100, ImageHeight: 100, Threads: 4, InputPath: filepath.Join(dir, "64x64x100."+format), OutputDir: dir}
+			if !checkEqualBoard(normalise(finalAliveCells(p)), normalise(expected)) {
+				t.Fatalf("the pattern read back from the %v file differs", format)
+			}
+		})
+	}
+}
+
+// TestFormatsInput reads a glider written by hand in each format, and a Life 1.05 file that
+// gives its own rule.
+func TestFormatsInput(t *testing.T) {
+	glider := []util.Cell{{X: 1, Y: 0}, {X: 2, Y: 1}, {X: 0, Y: 2}, {X: 1, Y: 2}, {X: 2, Y: 2}}
+	files := map[string]string{
+		"cells": "!Name: Glider\n!\n.O\n..O\nOOO\n",
+		"lif":   "#Life 1.06\n0 -1\n1 0\n-1 1\n0 1\n1 1\n",
+		"mc":    "[M2] (golly 4.2)\n#R B3/S23\n#G 0\n.*$..*$***$\n4 0 0 0 1\n",
+	}
+	for format, data := range files {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			writePattern(t, filepath.Join(dir, "glider."+format), data)
+			p := gol.Params{ImageWidth: 20, ImageHeight: 20, Threads: 1, InputPath: filepath.Join(dir, "glider."+format), OutputDir: dir}
+			if !checkEqualBoard(normalise(finalAliveCells(p)), glider) {
+				t.Fatalf("the glider read from the %v file differs", format)
+			}
+		})
+	}
+
+	// The Life 1.05 file has two blocks, and gives Seeds, B2/S, in S/B notation.
+	t.Run("lif-1.05", func(t *testing.T) {
+		dir := t.TempDir()
+		writePattern(t, filepath.Join(dir, "triominoes.lif"), "#Life 1.05\n#D Two triominoes\n#R /2\n#P -3 0\n**\n*\n#P 2 0\n.*\n**\n")
+		rule := util.Rule{Birth: 1 << 2}
+		start := []util.Cell{{X: 6, Y: 9}, {X: 7, Y: 9}, {X: 6, Y: 10}, {X: 12, Y: 9}, {X: 11, Y: 10}, {X: 12, Y: 10}}
+		for _, turns := range []int{0, 1, 5} {
+			p := gol.Params{ImageWidth: 20, ImageHeight: 20, Turns: turns, Threads: 1, InputPath: filepath.Join(dir, "triominoes.lif"), OutputDir: dir}
+			expected := referenceRuleAliveCells(start, 20, 20, turns, rule)
+			assertEqualBoard(t, finalAliveCells(p), expected, p)
+		}
+	})
+}
+
+// TestFormatsStates checks that the states of a Generations rule come back from a macrocell file.
+func TestFormatsStates(t *testing.T) {
+	rule, _ := util.ParseRule("345/2/4")
+	alive := readAliveCells("images/64x64.pgm", 64, 64)
+	expected := referenceStates(alive, 64, 64, 20, rule)
+
+	dir := t.TempDir()
+	p := gol.Params{ImageWidth: 64, ImageHeight: 64, Turns: 20, Threads: 4, Rule: rule, Format: gol.MacrocellFormat, OutputDir: dir}
+	finalAliveCells(p)
+
+	// The run takes the rule from the file, and the cells in it end up in the middle of the world.
+	var cells []util.Cell
+	var states []uint8
+	events := make(chan gol.Event)
+	go gol.Run(gol.Params{ImageWidth: 100, ImageHeight: 100, Threads: 4, InputPath: filepath.Join(dir, "64x64x20.mc"), OutputDir: dir}, events, nil)
+	for event := range events {
+		if e, ok := event.(gol.CellsChanged); ok {
+			cells, states = e.Cells, e.States
+		}
+	}
+	var expectedCells []util.Cell
+	expectedStates := make(map[util.Cell]uint8)
+	for y := range expected {
+		for x, state := range expected[y] {
+			if state != 0 {
+				expectedCells = append(expectedCells, util.Cell{X: x, Y: y})
+				expectedStates[util.Cell{X: x, Y: y}] = state
+			}
+		}
+	}
+	normalisedExpected := normalise(expectedCells)
+	if !checkEqualBoard(normalise(cells), normalisedExpected) {
+		t.Fatalf("the cells read back from the mc file differ")
+	}
+	// Match each cell read back to the expected cell in the same place relative to the others.
+	offset := util.Cell{X: expectedCells[0].X - normalisedExpected[0].X, Y: expectedCells[0].Y - normalisedExpected[0].Y}
+	for i, cell := range normalise(cells) {
+		if want := expectedStates[util.Cell{X: cell.X + offset.X, Y: cell.Y + offset.Y}]; states[i] != want {
+			t.Fatalf("a cell came back in state %d, expected %d", states[i], want)
+		}
+	}
+}
+
+// TestFormatsSparse checks that a Life 1.06 file saved by the sparse engine lists the cells
+// where they are in the unbounded world.
+func TestFormatsSparse(t *testing.T) {
+	dir := t.TempDir()
+	p := gol.Params{ImageWidth: 16, ImageHeight: 16, Turns: 400, Threads: 4, Engine: gol.SparseEngine, Format: gol.LifeFormat, OutputDir: dir}
+	expected := finalAliveCells(p)
+
+	file, err := os.Open(filepath.Join(dir, "3x3x400.lif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var cells []util.Cell
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "#") {
+			continue
+		}
+		var cell util.Cell
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &cell.X, &cell.Y); err != nil {
+			t.Fatal(err)
+		}
+		cells = append(cells, cell)
+	}
+	assertEqualBoard(t, cells, expected, p)
+}
+
+// normalise moves cells so the smallest x and y are 0.
+func normalise(cells []util.Cell) []util.Cell {
+	if len(cells) == 0 {
+		return cells
+	}
+	minX, minY := cells[0].X, cells[0].Y
+	for _, cell := range cells {
+		if cell.X < minX {
+			minX = cell.X
+		}
+		if cell.Y < minY {
+			minY = cell.Y
+		}
+	}
+	moved := make([]util.Cell, len(cells))
+	for i, cell := range cells {
+		moved[i] = util.Cell{X: cell.X - minX, Y: cell.Y - minY}
+	}
+	return moved
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TestGenerations runs the 64x64 image under Brian's Brain and Star Wars. It checks the final
+// alive cells, the states sent in CellsChanged events and the grey levels of the output image
+// against the reference.
+func TestGenerations(t *testing.T) {
+	alive := readAliveCells("images/64x64.pgm", 64, 64)
+	for _, name := range []string{"B2/S/C3", "345/2/4"} {
+		rule, err := util.ParseRule(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, turns := range []int{0, 1, 20} {
+			expected := referenceStates(alive, 64, 64, turns, rule)
+			for _, threads := range []int{1, 4} {
+				p := gol.Params{ImageWidth: 64, ImageHeight: 64, Turns: turns, Threads: threads, Rule: rule}
+				t.Run(fmt.Sprintf("%v-%d-%d", rule, turns, threads), func(t *testing.T) {
+					emptyOutFolder()
+					events := make(chan gol.Event)
+					go gol.Run(p, events, nil)
+
+					states := make([][]uint8, 64)
+					for y := range states {
+						states[y] = make([]uint8, 64)
+					}
+					var cells []util.Cell
+					for event := range events {
+						switch e := event.(type) {
+						case gol.CellsChanged:
+							for i, cell := range e.Cells {
+								states[cell.Y][cell.X] = e.States[i]
+							}
+						case gol.CellsFlipped:
+							t.Fatalf("CellsFlipped sent under a Generations rule")
+						case gol.FinalTurnComplete:
+							cells = e.Alive
+						}
+					}
+
+					var expectedAlive []util.Cell
+					for y := range expected {
+						for x := range expected[y] {
+							if expected[y][x] == 1 {
+								expectedAlive = append(expectedAlive, util.Cell{X: x, Y: y})
+							}
+						}
+					}
+					assertEqualBoard(t, cells, expectedAlive, p)
+
+					data, err := os.ReadFile(fmt.Sprintf("out/64x64x%d.pgm", turns))
+					if err != nil {
+						t.Fatal(err)
+					}
+					pixels := data[len(data)-64*64:]
+					for y := range expected {
+						for x := range expected[y] {
+							if states[y][x] != expected[y][x] {
+								t.Fatalf("events left (%d, %d) in state %d, expected %d", x, y, states[y][x], expected[y][x])
+							}
+							if pixels[y*64+x] != rule.Pixel(expected[y][x]) {
+								t.Fatalf("(%d, %d) has grey level %d, expected %d", x, y, pixels[y*64+x], rule.Pixel(expected[y][x]))
+							}
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestGenerationsPixels checks that every state of a Generations rule survives a trip through
+// a grey level.
+func TestGenerationsPixels(t *testing.T) {
+	for _, states := range []int{3, 4, 25, 256} {
+		rule := util.Rule{Birth: 1 << 2, States: states}
+		for state := 0; state < states; state++ {
+			if got := rule.State(rule.Pixel(uint8(state))); got != uint8(state) {
+				t.Errorf("state %d of %d came back as %d", state, states, got)
+			}
+		}
+	}
+}
+
+// referenceStates runs a straightforward single-threaded Generations rule on a width x height torus.
+func referenceStates(alive []util.Cell, width, height, turns int, rule util.Rule) [][]uint8 {
+	world := make([][]uint8, height)
+	for y := range world {
+		world[y] = make([]uint8, width)
+	}
+	for _, cell := range alive {
+		world[cell.Y][cell.X] = 1
+	}
+
+	for turn := 0; turn < turns; turn++ {
+		next := make([][]uint8, height)
+		for y := range next {
+			next[y] = make([]uint8, width)
+			for x := range next[y] {
+				neighbours := 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						if (dy != 0 || dx != 0) && world[(y+dy+height)%height][(x+dx+width)%width] == 1 {
+							neighbours++
+						}
+					}
+				}
+				switch state := world[y][x]; {
+				case state == 0 && rule.Birth&(1<<uint(neighbours)) != 0:
+					next[y][x] = 1
+				case state == 1 && rule.Survive&(1<<uint(neighbours)) != 0:
+					next[y][x] = 1
+				case state >= 1 && int(state)+1 < rule.States:
+					next[y][x] = state + 1
+				}
+			}
+		}
+		world = next
+	}
+	return world
+}
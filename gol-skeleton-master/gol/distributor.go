@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"net/rpc"
-	"sync"
 	"time"
 	"uk.ac.bris.cs/gameoflife/gol/stubs"
 	"uk.ac.bris.cs/gameoflife/util"
@@ -15,173 +14,346 @@ type distributorChannels struct {
 	ioCommand  chan<- ioCommand
 	ioIdle     <-chan bool
 	ioFilename chan<- string
+	ioHeader   chan<- imageHeader
 	ioOutput   chan<- uint8
 	ioInput    <-chan uint8
+	ioRule     <-chan util.Rule
 	keyPresses <-chan rune
 }
 
-// distributor divides the work between workers and interacts with other goroutines.
-func distributor(p Params, c distributorChannels) {
+// engine runs the turns for the distributor: a session on a broker, or the local engine.
+type engine interface {
+	// control performs one of stubs.Pause, stubs.Resume, stubs.Snapshot, stubs.Detach or stubs.Shutdown.
+	control(method string) (stubs.ControlResponse, error)
+}
 
-	go startIo(p, ioChannels{})
-	c.ioCommand <- ioInput
+// brokerEngine is a session running on a broker.
+type brokerEngine struct {
+	client  *rpc.Client
+	session string
+}
 
-	c.ioFilename <- fmt.Sprintf("%vx%v", p.ImageWidth, p.ImageHeight)
+func (b *brokerEngine) control(method string) (stubs.ControlResponse, error) {
+	response := new(stubs.ControlResponse)
+	err := b.client.Call(method, stubs.ControlRequest{SessionID: b.session}, response)
+	return *response, err
+}
+
+// sessionSize asks a broker for the size of the world of a session, so the window can be opened
+// at that size before attaching to it. An empty session means the most recently started one.
+func sessionSize(broker string, session string) (int, int, error) {
+	client, err := stubs.Dial(broker, 10*time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer client.Close()
 
-	nextWorld := make([][]byte, p.ImageHeight)
-	for i := range nextWorld {
-		nextWorld[i] = make([]byte, p.ImageWidth)
+	response := new(stubs.ControlResponse)
+	if err := client.Call(stubs.Snapshot, stubs.ControlRequest{SessionID: session}, response); err != nil {
+		return 0, 0, err
+	}
+	if response.World == nil {
+		return 0, 0, fmt.Errorf("session %v sent no world", response.SessionID)
 	}
+	return response.World.Width, response.World.Height, nil
+}
+
+// distributor divides the work between workers and interacts with other goroutines.
+func distributor(p Params, c distributorChannels) {
 
+	turn := 0
+	paused := false
+	finished := make(chan Value, 1)
+	// Stop streaming events once this controller has returned.
+	stop := make(chan struct{})
+	defer close(stop)
+	polled := make(chan []stubs.SessionEvent)
+
+	// The cells alive at the start are sent to the GUI as flipped. Under a Generations rule
+	// every cell that isn't dead is sent with its state instead.
 	flippedCells := []util.Cell{}
+	var initialStates []uint8
 
-	for y := 0; y < p.ImageHeight; y++ {
-		for x := 0; x < p.ImageWidth; x++ {
+	// The image may give its own rule, so it is read before the rule is checked.
+	var world *util.StateGrid
+	if !p.Attach {
+		world, p.Rule = readWorld(p, c)
+	}
 
-			pixelValue := <-c.ioInput
-			if pixelValue == 255 {
-				flipped := util.Cell{x, y}
-				flippedCells = append(flippedCells, flipped)
+	knownFormat := p.Format == ""
+	for _, format := range formats {
+		knownFormat = knownFormat || p.Format == format
+	}
+	if !knownFormat {
+		log.Fatalf("Unknown image format %q", p.Format)
+	}
+	if p.Engine != "" && p.Engine != GridEngine && p.Engine != HashLifeEngine && p.Engine != SparseEngine {
+		log.Fatalf("Unknown engine %q", p.Engine)
+	}
+	if p.Rule.Generations() && (p.Broker != "" || p.Engine == HashLifeEngine || p.Engine == SparseEngine) {
+		log.Fatalf("Generations rules such as %v only run locally on the grid engine", p.Rule)
+	}
+	if p.Engine == HashLifeEngine && p.Topology != util.Torus && p.Topology != util.Plane {
+		log.Fatalf("The hashlife engine only runs on a torus or a plane, not a %v", p.Topology)
+	}
+	if p.Engine == SparseEngine {
+		if p.Topology != util.Torus {
+			log.Fatalf("The sparse engine runs an unbounded world, which has no edges to join as a %v", p.Topology)
+		}
+		if p.Rule.Birth&1 != 0 {
+			log.Fatalf("Rules with B0 such as %v would fill an unbounded world, so they cannot run on the sparse engine", p.Rule)
+		}
+	}
+
+	var run engine
+	if p.Broker == "" {
+		if p.Attach {
+			log.Fatalf("Attaching to a run needs the address of a broker")
+		}
+		if p.Rule.Generations() {
+			flippedCells, initialStates = util.NewStateGrid(p.ImageWidth, p.ImageHeight).ChangedCells(world, 0, p.ImageHeight)
+		} else {
+			flippedCells = world.Alive().AliveCells(0)
+		}
+		run = startLocal(p, world, polled, finished, stop)
+	} else {
+		if p.Engine == HashLifeEngine || p.Engine == SparseEngine {
+			log.Fatalf("The %v engine only runs locally, without a broker", p.Engine)
+		}
+		client, err := stubs.Dial(p.Broker, 10*time.Second)
+		if err != nil {
+			log.Fatalf("Error connecting to broker at %v: %v", p.Broker, err)
+		}
+		defer client.Close()
+
+		var session string
+		if p.Attach {
+			// Pick up a session already in progress on the broker instead of starting from the image.
+			response := new(stubs.ControlResponse)
+			if err := client.Call(stubs.Attach, stubs.ControlRequest{SessionID: p.Session}, response); err != nil {
+				log.Fatalf("Error attaching to broker at %v: %v", p.Broker, err)
+			}
+			if response.World == nil {
+				log.Fatalf("Session %v on the broker sent no world", response.SessionID)
+			}
+			// The window was opened at the size given by -w and -h, or else the size of the session's world.
+			if response.World.Width != p.ImageWidth || response.World.Height != p.ImageHeight {
+				log.Fatalf("Session %v on the broker has a %vx%v world, not %vx%v", response.SessionID, response.World.Width, response.World.Height, p.ImageWidth, p.ImageHeight)
+			}
+			p.Rule, p.Topology = response.Rule, response.Topology
+			turn, paused, session = response.Turn, response.Paused, response.SessionID
+			flippedCells = response.World.AliveCells(0)
+			fmt.Printf("Attached to session %v at turn %v of %v\n", session, response.Turn, response.Turns)
+		} else {
+			alive := world.Alive()
+			flippedCells = alive.AliveCells(0)
+
+			request := stubs.InitialRequest{NextWorld: alive, Width: p.ImageWidth, Height: p.ImageHeight, Turns: p.Turns, ThreadCount: p.Threads, SkipFrames: p.SkipFrames, Rule: p.Rule, Topology: p.Topology}
+			response := new(stubs.StartResponse)
+			if err := client.Call(stubs.StartMaster, request, response); err != nil {
+				log.Fatalf("Error starting a run on the broker at %v: %v", p.Broker, err)
 			}
-			nextWorld[y][x] = pixelValue
+			session = response.SessionID
+			fmt.Printf("Started session %v\n", session)
 		}
+		run = &brokerEngine{client: client, session: session}
+		go streamEvents(client, session, polled, finished, stop)
 	}
-	responseChannel := make(chan stubs.FinalResponse)
-	done := make(chan bool)
 
-	fmt.Println("ive made it here")
+	if p.Rule.Generations() {
+		c.events <- CellsChanged{turn, flippedCells, initialStates}
+	} else {
+		c.events <- CellsFlipped{turn, flippedCells}
+	}
+	if paused {
+		c.events <- StateChange{turn, Paused}
+	} else {
+		c.events <- StateChange{turn, Executing}
+	}
 
-	//requestChan := make(chan struct{})
-	// Channel for request signals
+	for {
+		select {
+		case values := <-finished:
+			if values.Err != nil {
+				log.Fatalf("%v", values.Err)
+			}
 
-	//var ticker *time.Ticker
-	//ticker = time.NewTicker(2 * time.Second)
-	//go background(requestChan, p, c, currentWorld, currentTurn, done, ticker)
-	//go keyListener(c, pauseSignal, playSignal, quitSignal, saveSignal)
+			writeImage(p, c, values.World, values.States, values.Origin, values.TurnCompleted)
+			c.events <- FinalTurnComplete{CompletedTurns: values.TurnCompleted, Alive: values.AliveCells}
+			quit(c, values.TurnCompleted)
+			return
 
-	turn := 0
-	//c.events <- CellsFlipped{turn, flippedCells}
-	c.events <- StateChange{turn, Executing}
+		case batch := <-polled:
+			for _, event := range batch {
+				forwardEvent(c, event)
+			}
 
-	c.ioCommand <- ioOutput
-	//filename := strconv.Itoa(p.ImageWidth) + "x" + strconv.Itoa(p.ImageHeight) + "x" + strconv.Itoa(p.Threads)
+		case keyPressed := <-c.keyPresses:
+			switch keyPressed {
+			case 'p':
+				// The StateChange event arrives from the engine once the turn loop has paused.
+				method := stubs.Pause
+				if paused {
+					method = stubs.Resume
+				}
+				if _, err := run.control(method); err != nil {
+					log.Printf("%v failed: %v", method, err)
+					continue
+				}
+				paused = !paused
+			case 's':
+				saveSnapshot(p, c, run)
+			case 'q':
+				// Leave the broker running without this controller.
+				turn = saveSnapshot(p, c, run)
+				if _, err := run.control(stubs.Detach); err != nil {
+					log.Printf("Detach failed: %v", err)
+				}
+				quit(c, turn)
+				return
+			case 'k':
+				// Save the final state, then shut down the broker and every worker.
+				turn = saveSnapshot(p, c, run)
+				if _, err := run.control(stubs.Shutdown); err != nil {
+					log.Printf("Shutdown failed: %v", err)
+				}
+				quit(c, turn)
+				return
+			}
+		}
+	}
+}
 
-	// TODO: Execute all turns of the Game of Life.
-	client, _ := rpc.Dial("tcp", "ec2-3-233-250-228.compute-1.amazonaws.com:8030")
-	defer client.Close()
-	var ticker *time.Ticker
-	ticker = time.NewTicker(2 * time.Second)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go background(client, done, ticker, c, &wg)
-	wg.Add(1)
-	values2 := makeCall(client, nextWorld, p.Turns, p.Threads, responseChannel, &wg)
-	wg.Wait()
-	//nuke := values.World
-	nukeAlive := values2.AliveCells
-	nukeCompletedTurns := values2.TurnCompleted
-	//nukeFinalWorld := nuke.FinalWorld
-
-	// TODO: Report the final state using FinalTurnCompleteEvent.
-	//close(done)
-
-	c.events <- FinalTurnComplete{CompletedTurns: nukeCompletedTurns, Alive: nukeAlive}
-	close(done)
-
-	//c.ioFilename <- fmt.Sprintf("%vx%vx%v", p.ImageWidth, p.ImageHeight, turn)
-
-	//for y := 0; y < p.ImageHeight; y++ {
-	//for x := 0; x < p.ImageWidth; x++ {
-
-	//pixelValue := nextWorld[y][x]
-	//c.ioOutput <- pixelValue
-	//}
-	//}
-
-	//c.ioCommand <- ioCheckIdle
-	//<-c.ioIdle
-	//c.events <- ImageOutputComplete{CompletedTurns: turn, Filename: filename}
-
-	//c.ioCommand <- ioCheckIdle
-	//<-c.ioIdle
-	fmt.Println("im here now4", p.Turns, p.Threads)
+// readWorld loads the input image for the run through the io goroutine, turning the grey level
+// of each pixel into the state of its cell under the rule. It returns the world and the rule,
+// which is the one given in the image if it has one.
+func readWorld(p Params, c distributorChannels) (*util.StateGrid, util.Rule) {
+	c.ioCommand <- ioInput
+
+	c.ioFilename <- fmt.Sprintf("%vx%v", p.ImageWidth, p.ImageHeight)
+
+	rule := <-c.ioRule
+	world := util.NewStateGrid(p.ImageWidth, p.ImageHeight)
+	for y := 0; y < p.ImageHeight; y++ {
+		for x := 0; x < p.ImageWidth; x++ {
+			world.Set(x, y, rule.State(<-c.ioInput))
+		}
+	}
+	return world, rule
+}
 
+// quit waits for any output to finish and then tells the GUI to close.
+func quit(c distributorChannels, turn int) {
 	// Make sure that the Io has finished any output before exiting.
+	c.ioCommand <- ioCheckIdle
+	<-c.ioIdle
 
 	c.events <- StateChange{turn, Quitting}
-	fmt.Println("im here now5", p.Turns, p.Threads)
 
 	// Close the channel to stop the SDL goroutine gracefully. Removing may cause deadlock.
 	close(c.events)
-
-}
-
-type Value struct {
-	World         [][]byte
-	TurnCompleted int
-	AliveCells    []util.Cell
 }
 
-func makeCall(client *rpc.Client, worldProcess [][]byte, turns int, threads int, responseChannel chan stubs.FinalResponse, wg *sync.WaitGroup) Value {
-	defer wg.Done()
-	request := stubs.InitialRequest{NextWorld: worldProcess, Turns: turns, ThreadCount: threads}
-	if client == nil {
-		log.Fatal("RPC client is nil. Could not connect to the server.")
+// saveSnapshot asks the engine for the current world and writes it out as a pgm image.
+// It returns the turn the snapshot was taken at.
+func saveSnapshot(p Params, c distributorChannels, run engine) int {
+	response, err := run.control(stubs.Snapshot)
+	if err != nil {
+		log.Printf("Snapshot failed: %v", err)
+		return response.Turn
 	}
+	writeImage(p, c, response.World, response.States, response.Origin, response.Turn)
+	return response.Turn
+}
 
-	response := new(stubs.FinalResponse)
-	fmt.Println("im here now3")
-
-	err := client.Call(stubs.StartMaster, request, response)
-	if err != nil {
-		log.Fatalf("Error during RPC call2: %v", err)
+// writeImage sends a world to the io goroutine to be saved as WxHxT in the output directory.
+// When states is set, each cell is drawn with the grey level of its state under a Generations
+// rule. The origin is where the top left cell of world lies in an unbounded world.
+func writeImage(p Params, c distributorChannels, world *util.BitGrid, states *util.StateGrid, origin util.Cell, turn int) {
+	filename := fmt.Sprintf("%vx%vx%v", world.Width, world.Height, turn)
+	c.ioCommand <- ioOutput
+	c.ioFilename <- filename
+	c.ioHeader <- imageHeader{width: world.Width, height: world.Height, origin: origin, rule: p.Rule}
+
+	for y := 0; y < world.Height; y++ {
+		for x := 0; x < world.Width; x++ {
+			switch {
+			case states != nil:
+				c.ioOutput <- p.Rule.Pixel(states.Get(x, y))
+			case world.Get(x, y):
+				c.ioOutput <- 255
+			default:
+				c.ioOutput <- 0
+			}
+		}
 	}
 
-	fmt.Printf("passingBack from server.\n")
+	c.ioCommand <- ioCheckIdle
+	<-c.ioIdle
+	c.events <- ImageOutputComplete{CompletedTurns: turn, Filename: filename}
+}
 
-	return Value{AliveCells: response.AliveCells, World: response.FinalWorld, TurnCompleted: response.TurnsCompleted}
+type Value struct {
+	World         *util.BitGrid
+	Origin        util.Cell // where the top left cell of World lies, in an unbounded world
+	States        *util.StateGrid
+	TurnCompleted int
+	AliveCells    []util.Cell
+	Err           error
 }
 
-func keyListener(c distributorChannels) {
-	playState := "play"
-	for {
-		select {
-		case keyPressed := <-c.keyPresses:
-			if keyPressed == 'p' && playState == "play" {
-				playState = "pause"
-			} else if keyPressed == 'p' && playState == "pause" {
-				playState = "play"
-			} else if keyPressed == 'q' {
-			} else if keyPressed == 's' {
-			}
+// forwardEvent turns an event streamed from the engine into the matching Event for the GUI.
+func forwardEvent(c distributorChannels, event stubs.SessionEvent) {
+	switch event.Kind {
+	case stubs.TurnCompleteEvent:
+		c.events <- TurnComplete{CompletedTurns: event.Turn}
+	case stubs.CellsFlippedEvent:
+		c.events <- CellsFlipped{CompletedTurns: event.Turn, Cells: event.Cells}
+	case stubs.CellsChangedEvent:
+		c.events <- CellsChanged{CompletedTurns: event.Turn, Cells: event.Cells, States: event.States}
+	case stubs.AliveCellsCountEvent:
+		c.events <- AliveCellsCount{CompletedTurns: event.Turn, CellsCount: event.AliveCount}
+	case stubs.StateChangeEvent:
+		if event.Paused {
+			c.events <- StateChange{event.Turn, Paused}
+		} else {
+			c.events <- StateChange{event.Turn, Executing}
 		}
+	case stubs.WorkerFailedEvent:
+		c.events <- WorkerFailed{CompletedTurns: event.Turn, Worker: event.Worker}
 	}
 }
 
-func background(client *rpc.Client, done chan bool, ticker *time.Ticker, c distributorChannels, wg *sync.WaitGroup) {
-	defer wg.Done()
-	time.Sleep(2 * time.Second)
+// streamEvents long-polls the broker for the events of a session and passes them on in batches.
+// Once every event has been delivered it reports the result of the session on finished.
+func streamEvents(client *rpc.Client, session string, polled chan<- []stubs.SessionEvent, finished chan<- Value, stop <-chan struct{}) {
+	last := 0
 	for {
-		select {
-		case <-done:
-			ticker.Stop()
-			return
-		case <-ticker.C:
-			request := stubs.AliveRequest{TimeToRequest: true}
-			if client == nil {
-				log.Fatal("RPC client is nil. Could not connect to the server.")
+		response := new(stubs.PollResponse)
+		if err := client.Call(stubs.PollEvents, stubs.PollRequest{SessionID: session, After: last}, response); err != nil {
+			select {
+			case finished <- Value{Err: fmt.Errorf("PollEvents failed: %w", err)}:
+			case <-stop:
 			}
-
-			response := new(stubs.AliveResponse)
-			err := client.Call(stubs.RunTicker, request, response)
-			if err != nil {
-				log.Fatalf("Error during RPC call1: %v", err)
+			return
+		}
+		if response.Finished {
+			break
+		}
+		last = response.Last
+		if len(response.Events) > 0 {
+			select {
+			case polled <- response.Events:
+			case <-stop:
+				return
 			}
-
-			fmt.Printf("passingBack from server.\n")
-
-			c.events <- AliveCellsCount{CompletedTurns: response.CurrentTurns, CellsCount: response.AliveCellCount}
-
 		}
 	}
+
+	response := new(stubs.FinalResponse)
+	if err := client.Call(stubs.Wait, stubs.ControlRequest{SessionID: session}, response); err != nil {
+		finished <- Value{Err: fmt.Errorf("Wait failed: %w", err)}
+		return
+	}
+	finished <- Value{AliveCells: response.AliveCells, World: response.FinalWorld, TurnCompleted: response.TurnsCompleted}
 }
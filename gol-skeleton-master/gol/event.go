@@ -63,6 +63,15 @@ type CellsFlipped struct { // implements Event
 	Cells          []util.Cell
 }
 
+// `CellsChanged` is an Event notifying the GUI about cells changing state under a Generations rule.
+// It is sent instead of `CellsFlipped` when the rule has dying states. States[i] is the new state of Cells[i]:
+// 0 for dead, 1 for alive and 2 upwards for the dying states.
+type CellsChanged struct { // implements Event
+	CompletedTurns int
+	Cells          []util.Cell
+	States         []uint8
+}
+
 // `TurnComplete` is an Event notifying the GUI about turn completion.
 // SDL will render a frame when this event is sent.
 // All `CellFlipped` or `CellsFlipped` events must be sent *before* `TurnComplete`.
@@ -78,6 +87,13 @@ type FinalTurnComplete struct {
 	Alive          []util.Cell
 }
 
+// `WorkerFailed` is an Event notifying the user that a worker node stopped responding.
+// Its strips have been handed to the remaining workers, so execution carries on.
+type WorkerFailed struct { // implements Event
+	CompletedTurns int
+	Worker         string
+}
+
 // String methods allow the different types of Events and States to be printed.
 
 func (state State) String() string {
@@ -133,6 +149,14 @@ func (event CellsFlipped) GetCompletedTurns() int {
 	return event.CompletedTurns
 }
 
+func (event CellsChanged) String() string {
+	return ""
+}
+
+func (event CellsChanged) GetCompletedTurns() int {
+	return event.CompletedTurns
+}
+
 func (event TurnComplete) String() string {
 	return ""
 }
@@ -141,6 +165,14 @@ func (event TurnComplete) GetCompletedTurns() int {
 	return event.CompletedTurns
 }
 
+func (event WorkerFailed) String() string {
+	return fmt.Sprintf("Worker %v Failed", event.Worker)
+}
+
+func (event WorkerFailed) GetCompletedTurns() int {
+	return event.CompletedTurns
+}
+
 func (event FinalTurnComplete) String() string {
 	return "Final Turn Complete"
 }
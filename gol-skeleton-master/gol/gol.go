@@ -1,18 +1,98 @@
 package gol
 
+import (
+	"log"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
 // Params provides the details of how to run the Game of Life and which image to load.
 type Params struct {
 	Turns       int
-	Threads     int
+	Threads     int // 8 for a local run when 0, and each worker's own -threads on a broker
 	ImageWidth  int
 	ImageHeight int
+	Broker      string
+	Attach      bool
+	Session     string
+	SkipFrames  bool
+	Engine      string
+	Rule        util.Rule // Life when left as the zero Rule
+	Topology    util.Topology
+	Format      string     // the format images are saved in, pgm when empty
+	Offset      *util.Cell // where the top left cell of a pattern goes, the middle of the world when nil
+	InputPath   string     // the image to start from, images/WxH when empty
+	OutputDir   string     // where images are saved, out when empty
+}
+
+// Engines a local run can use. The grid engine is used when Params.Engine is empty. The sparse
+// engine runs an unbounded world, taking ImageWidth and ImageHeight as the initial viewport.
+const (
+	GridEngine     = "grid"
+	HashLifeEngine = "hashlife"
+	SparseEngine   = "sparse"
+)
+
+// Formats images are read and written in, named by their file extensions. Life files are
+// written as Life 1.06, and read as Life 1.05 or 1.06.
+const (
+	PgmFormat       = "pgm"
+	RleFormat       = "rle"
+	CellsFormat     = "cells"
+	LifeFormat      = "lif"
+	MacrocellFormat = "mc"
+)
+
+// defaultSize is the width and height of the world when there is no input image to take them from.
+const defaultSize = 512
+
+// WithImageSize returns p with a zero ImageWidth or ImageHeight taken from the size of the
+// input image, or of the session's world when attaching to a run on a broker, or defaultSize
+// when there is neither.
+func (p Params) WithImageSize() (Params, error) {
+	if p.ImageWidth != 0 && p.ImageHeight != 0 {
+		return p, nil
+	}
+	width, height := defaultSize, defaultSize
+	var err error
+	switch {
+	case p.Attach && p.Broker != "":
+		width, height, err = sessionSize(p.Broker, p.Session)
+	case p.InputPath != "":
+		width, height, err = ImageSize(p.InputPath)
+	}
+	if err != nil {
+		return p, err
+	}
+	if p.ImageWidth == 0 {
+		p.ImageWidth = width
+	}
+	if p.ImageHeight == 0 {
+		p.ImageHeight = height
+	}
+	return p, nil
 }
 
+// defaultThreads is how many goroutines a local run uses when Params.Threads is 0.
+const defaultThreads = 8
+
 // Run starts the processing of Game of Life. It should initialise channels and goroutines.
 func Run(p Params, events chan<- Event, keyPresses <-chan rune) {
+	if p.Rule == (util.Rule{}) {
+		p.Rule = util.Life
+	}
+	if p.Threads == 0 && p.Broker == "" {
+		p.Threads = defaultThreads
+	}
+	p, err := p.WithImageSize()
+	if err != nil {
+		log.Fatalf("Error finding the size of the world: %v", err)
+	}
 
 	ioFilename := make(chan string)
+	ioHeader := make(chan imageHeader)
 	ioInput := make(chan uint8)
+	ioRule := make(chan util.Rule)
 	ioOutput := make(chan uint8)
 
 	ioCommand := make(chan ioCommand)
@@ -22,8 +102,10 @@ func Run(p Params, events chan<- Event, keyPresses <-chan rune) {
 		command:  ioCommand,
 		idle:     ioIdle,
 		filename: ioFilename,
+		header:   ioHeader,
 		output:   ioOutput,
 		input:    ioInput,
+		rule:     ioRule,
 	}
 	go startIo(p, ioChannels)
 
@@ -32,8 +114,10 @@ func Run(p Params, events chan<- Event, keyPresses <-chan rune) {
 		ioCommand:  ioCommand,
 		ioIdle:     ioIdle,
 		ioFilename: ioFilename,
+		ioHeader:   ioHeader,
 		ioOutput:   ioOutput,
 		ioInput:    ioInput,
+		ioRule:     ioRule,
 		keyPresses: keyPresses,
 	}
 	distributor(p, distributorChannels)
@@ -1,8 +1,10 @@
 package gol
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"uk.ac.bris.cs/gameoflife/util"
@@ -13,8 +15,18 @@ type ioChannels struct {
 	idle    chan<- bool
 
 	filename <-chan string
+	header   <-chan imageHeader
 	output   <-chan uint8
 	input    chan<- uint8
+	rule     chan<- util.Rule
+}
+
+// imageHeader describes an image about to be output: its size, where its top left pixel lies in
+// the world, and the rule the world is run under.
+type imageHeader struct {
+	width, height int
+	origin        util.Cell
+	rule          util.Rule
 }
 
 // ioState is the internal ioState of the io goroutine.
@@ -40,31 +52,36 @@ const (
 
 // writePgmImage receives an array of bytes and writes it to a pgm file.
 func (io *ioState) writePgmImage() {
-	_ = os.Mkdir("out", os.ModePerm)
+	_ = os.MkdirAll(io.outputDir(), os.ModePerm)
 
-	// Request a filename from the distributor.
+	// Request a filename and the header of the image from the distributor.
 	filename := <-io.channels.filename
+	header := <-io.channels.header
 
-	file, ioError := os.Create("out/" + filename + ".pgm")
+	file, ioError := os.Create(filepath.Join(io.outputDir(), filename+".pgm"))
 	util.Check(ioError)
 	defer file.Close()
 
 	_, _ = file.WriteString("P5\n")
 	//_, _ = file.WriteString("# PGM file writer by pnmmodules (https://github.com/owainkenwayucl/pnmmodules).\n")
-	_, _ = file.WriteString(strconv.Itoa(io.params.ImageWidth))
+	if io.params.Engine == SparseEngine {
+		// The image is the bounding box of an unbounded world, so record where it lies.
+		_, _ = file.WriteString(fmt.Sprintf("# origin %d %d\n", header.origin.X, header.origin.Y))
+	}
+	_, _ = file.WriteString(strconv.Itoa(header.width))
 	_, _ = file.WriteString(" ")
-	_, _ = file.WriteString(strconv.Itoa(io.params.ImageHeight))
+	_, _ = file.WriteString(strconv.Itoa(header.height))
 	_, _ = file.WriteString("\n")
 	_, _ = file.WriteString(strconv.Itoa(255))
 	_, _ = file.WriteString("\n")
 
-	world := make([][]byte, io.params.ImageHeight)
+	world := make([][]byte, header.height)
 	for i := range world {
-		world[i] = make([]byte, io.params.ImageWidth)
+		world[i] = make([]byte, header.width)
 	}
 
-	for y := 0; y < io.params.ImageHeight; y++ {
-		for x := 0; x < io.params.ImageWidth; x++ {
+	for y := 0; y < header.height; y++ {
+		for x := 0; x < header.width; x++ {
 			val := <-io.channels.output
 			//if val != 0 {
 			//	fmt.Println(x, y)
@@ -73,8 +90,8 @@ func (io *ioState) writePgmImage() {
 		}
 	}
 
-	for y := 0; y < io.params.ImageHeight; y++ {
-		for x := 0; x < io.params.ImageWidth; x++ {
+	for y := 0; y < header.height; y++ {
+		for x := 0; x < header.width; x++ {
 			_, ioError = file.Write([]byte{world[y][x]})
 			util.Check(ioError)
 		}
@@ -86,16 +103,166 @@ func (io *ioState) writePgmImage() {
 	fmt.Println("File", filename, "output done!")
 }
 
-// readPgmImage opens a pgm file and sends its data as an array of bytes.
-func (io *ioState) readPgmImage() {
+// writePatternImage receives an array of bytes and writes it to a file in one of the pattern
+// formats shared with other tools: rle, cells, lif or mc.
+func (io *ioState) writePatternImage() {
+	_ = os.MkdirAll(io.outputDir(), os.ModePerm)
+
+	// Request a filename and the header of the image from the distributor.
+	filename := <-io.channels.filename
+	header := <-io.channels.header
+
+	world := util.NewStateGrid(header.width, header.height)
+	for y := 0; y < header.height; y++ {
+		for x := 0; x < header.width; x++ {
+			world.Set(x, y, header.rule.State(<-io.channels.output))
+		}
+	}
+
+	// The image of an unbounded world is its bounding box. Life 1.06 and macrocell files give
+	// where the cells lie themselves, and the other formats record it in a comment.
+	var data []byte
+	unbounded := io.params.Engine == SparseEngine
+	switch io.params.Format {
+	case RleFormat:
+		if unbounded {
+			data = []byte(fmt.Sprintf("#R %d %d\n", header.origin.X, header.origin.Y))
+		}
+		data = append(data, encodeRle(world, header.rule)...)
+	case CellsFormat:
+		data = []byte(fmt.Sprintf("!Name: %v\n", filename))
+		if unbounded {
+			data = append(data, fmt.Sprintf("!Origin: %d %d\n", header.origin.X, header.origin.Y)...)
+		}
+		data = append(data, encodeCells(world)...)
+	case LifeFormat:
+		data = encodeLife(world, header.origin)
+	case MacrocellFormat:
+		data = encodeMacrocell(world, header.rule, header.origin)
+	}
+	util.Check(os.WriteFile(filepath.Join(io.outputDir(), filename+"."+io.params.Format), data, 0666))
+
+	fmt.Println("File", filename, "output done!")
+}
+
+// formats are the formats images can be read and written in, in the order an input image is
+// looked for in.
+var formats = []string{PgmFormat, RleFormat, CellsFormat, LifeFormat, MacrocellFormat}
+
+// formatOf returns the format of the image at path, from its extension.
+func formatOf(path string) (string, error) {
+	extension := strings.TrimPrefix(filepath.Ext(path), ".")
+	for _, format := range formats {
+		if extension == format {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("%v is not in any of the formats %v", path, strings.Join(formats, ", "))
+}
+
+// outputDir returns the directory images are saved in.
+func (io *ioState) outputDir() string {
+	if io.params.OutputDir == "" {
+		return "out"
+	}
+	return io.params.OutputDir
+}
+
+// readImage reads the input image, from Params.InputPath or else from the first format it was
+// saved in as images/WxH, and sends the rule to run it under followed by the grey level of
+// every cell.
+func (io *ioState) readImage() {
 	// Request a filename from the distributor.
 	filename := <-io.channels.filename
-	data, ioError := os.ReadFile("images/" + filename + ".pgm")
-	util.Check(ioError)
+	if io.params.InputPath != "" {
+		format, ioError := formatOf(io.params.InputPath)
+		util.Check(ioError)
+		data, ioError := os.ReadFile(io.params.InputPath)
+		util.Check(ioError)
+		io.readFormat(format, data)
+		fmt.Println("File", io.params.InputPath, "input done!")
+		return
+	}
 
-	fields := strings.Fields(string(data))
+	for _, format := range formats {
+		data, ioError := os.ReadFile("images/" + filename + "." + format)
+		if os.IsNotExist(ioError) {
+			continue
+		}
+		util.Check(ioError)
+		io.readFormat(format, data)
+		fmt.Println("File", filename, "input done!")
+		return
+	}
+	panic(fmt.Sprintf("No image images/%v in any of the formats %v", filename, strings.Join(formats, ", ")))
+}
+
+// readFormat reads an image in the given format and sends it on.
+func (io *ioState) readFormat(format string, data []byte) {
+	if format == PgmFormat {
+		io.readPgmImage(data)
+		return
+	}
+	pattern, rule, err := decodePattern(format, data, io.params.Rule)
+	util.Check(err)
+	io.sendPattern(pattern, rule)
+}
+
+// decodePattern reads a pattern in one of the formats shared with other tools, and the rule it
+// gives. The rule given is used when it gives none.
+func decodePattern(format string, data []byte, rule util.Rule) (*util.StateGrid, util.Rule, error) {
+	switch format {
+	case RleFormat:
+		return decodeRle(data, rule)
+	case CellsFormat:
+		pattern, err := decodeCells(data)
+		return pattern, rule, err
+	case LifeFormat:
+		return decodeLife(data, rule)
+	case MacrocellFormat:
+		return decodeMacrocell(data, rule)
+	}
+	return nil, rule, fmt.Errorf("%v is not a pattern format", format)
+}
+
+// ImageSize returns the width and height of the image at path: the size in the header of a pgm
+// or rle file, and the size of the smallest rectangle holding the pattern in the other formats.
+func ImageSize(path string) (int, int, error) {
+	format, err := formatOf(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	if fields[0] != "P5" {
+	var width, height int
+	if format == PgmFormat {
+		fields := pgmFields(data)
+		if len(fields) < 3 || fields[0] != "P5" {
+			return 0, 0, fmt.Errorf("%v is not a pgm file", path)
+		}
+		width, _ = strconv.Atoi(fields[1])
+		height, _ = strconv.Atoi(fields[2])
+	} else {
+		pattern, _, err := decodePattern(format, data, util.Life)
+		if err != nil {
+			return 0, 0, err
+		}
+		width, height = pattern.Width, pattern.Height
+	}
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("%v has no size", path)
+	}
+	return width, height, nil
+}
+
+// readPgmImage sends the data of a pgm file as an array of bytes.
+func (io *ioState) readPgmImage(data []byte) {
+	fields := pgmFields(data)
+
+	if len(fields) != 5 || fields[0] != "P5" {
 		panic("Not a pgm file")
 	}
 
@@ -116,11 +283,598 @@ func (io *ioState) readPgmImage() {
 
 	image := []byte(fields[4])
 
+	io.channels.rule <- io.params.Rule
 	for _, b := range image {
 		io.channels.input <- b
 	}
+}
+
+// sendPattern places a pattern read from a file into the world, and sends the rule it gives
+// and the grey level of every cell.
+func (io *ioState) sendPattern(pattern *util.StateGrid, rule util.Rule) {
+	if rule != io.params.Rule {
+		fmt.Println("Using the rule", rule, "given in the pattern")
+	}
+
+	// Put the pattern in the middle of the world unless it has been given an offset.
+	offset := util.Cell{X: (io.params.ImageWidth - pattern.Width) / 2, Y: (io.params.ImageHeight - pattern.Height) / 2}
+	if io.params.Offset != nil {
+		offset = *io.params.Offset
+	}
+	if offset.X < 0 || offset.Y < 0 || offset.X+pattern.Width > io.params.ImageWidth || offset.Y+pattern.Height > io.params.ImageHeight {
+		panic(fmt.Sprintf("A %vx%v pattern at (%v, %v) does not fit in the world", pattern.Width, pattern.Height, offset.X, offset.Y))
+	}
+
+	io.channels.rule <- rule
+	for y := 0; y < io.params.ImageHeight; y++ {
+		for x := 0; x < io.params.ImageWidth; x++ {
+			px, py := x-offset.X, y-offset.Y
+			if px >= 0 && py >= 0 && px < pattern.Width && py < pattern.Height {
+				io.channels.input <- rule.Pixel(pattern.Get(px, py))
+			} else {
+				io.channels.input <- 0
+			}
+		}
+	}
+}
+
+// decodeRle reads a pattern in the run length encoded format of Golly and LifeWiki, and the rule
+// in its header. The rule given is used when the header has none.
+func decodeRle(data []byte, rule util.Rule) (*util.StateGrid, util.Rule, error) {
+	lines := strings.Split(string(data), "\n")
+	header := -1
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			header = i
+			break
+		}
+	}
+	if header == -1 {
+		return nil, rule, fmt.Errorf("rle file has no header")
+	}
+
+	// The rule runs to the end of the line, as the bounds Golly may add after it hold commas.
+	fields := lines[header]
+	if i := strings.Index(fields, "rule"); i >= 0 {
+		parts := strings.SplitN(fields[i:], "=", 2)
+		if len(parts) != 2 {
+			return nil, rule, fmt.Errorf("rle header field %q is not of the form key = value", fields[i:])
+		}
+		// The bounds after the colon are left to the topology.
+		var err error
+		rule, err = util.ParseRule(strings.SplitN(strings.TrimSpace(parts[1]), ":", 2)[0])
+		if err != nil {
+			return nil, rule, fmt.Errorf("rle header: %v", err)
+		}
+		fields = strings.TrimSuffix(strings.TrimSpace(fields[:i]), ",")
+	}
+
+	width, height := -1, -1
+	for _, field := range strings.Split(fields, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, rule, fmt.Errorf("rle header field %q is not of the form key = value", field)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var err error
+		switch key {
+		case "x":
+			width, err = strconv.Atoi(value)
+		case "y":
+			height, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return nil, rule, fmt.Errorf("rle header: %v", err)
+		}
+	}
+	if width < 0 || height < 0 {
+		return nil, rule, fmt.Errorf("rle header %q does not give x and y", lines[header])
+	}
+
+	pattern := util.NewStateGrid(width, height)
+	x, y, run, prefix := 0, 0, 0, 0
+	body := strings.Join(lines[header+1:], "")
+	for _, c := range body {
+		if c == '!' {
+			break
+		}
+		count := run
+		if count == 0 {
+			count = 1
+		}
+		var state int
+		switch {
+		case c >= '0' && c <= '9':
+			run = run*10 + int(c-'0')
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			continue
+		case c == '$':
+			x, y, run = 0, y+count, 0
+			continue
+		case c >= 'p' && c <= 'y':
+			// The first letter of a state above 24.
+			prefix = int(c-'p') + 1
+			continue
+		case c == 'b' || c == '.':
+			state = 0
+		case c >= 'A' && c <= 'X':
+			state = 24*prefix + int(c-'A') + 1
+		case c >= 'a' && c <= 'z':
+			// Any other letter is an alive cell.
+			state = 1
+		default:
+			return nil, rule, fmt.Errorf("rle pattern has an unexpected %q", c)
+		}
+		if state != 0 {
+			if !rule.Generations() {
+				state = 1
+			} else if state >= rule.States {
+				return nil, rule, fmt.Errorf("rle pattern has state %d, but %v only has %d states", state, rule, rule.States)
+			}
+			if x+count > width || y >= height {
+				return nil, rule, fmt.Errorf("rle pattern goes beyond x = %d, y = %d", width, height)
+			}
+			for i := 0; i < count; i++ {
+				pattern.Set(x+i, y, uint8(state))
+			}
+		}
+		x, run, prefix = x+count, 0, 0
+	}
+	return pattern, rule, nil
+}
+
+// rleLineLength is the longest line encodeRle writes, as other tools expect.
+const rleLineLength = 70
+
+// encodeRle writes a world in the run length encoded format of Golly and LifeWiki.
+func encodeRle(world *util.StateGrid, rule util.Rule) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "x = %d, y = %d, rule = %v\n", world.Width, world.Height, rule)
 
-	fmt.Println("File", filename, "input done!")
+	line := 0
+	write := func(count int, tag string) {
+		if count > 1 {
+			tag = strconv.Itoa(count) + tag
+		}
+		if line+len(tag) > rleLineLength {
+			b.WriteByte('\n')
+			line = 0
+		}
+		b.WriteString(tag)
+		line += len(tag)
+	}
+
+	// lastY is the row the pattern has been written up to.
+	lastY := 0
+	for y := 0; y < world.Height; y++ {
+		row := world.Row(y)
+		// Dead cells at the end of a row are left out.
+		end := len(row)
+		for end > 0 && row[end-1] == 0 {
+			end--
+		}
+		if end == 0 {
+			continue
+		}
+		if y > lastY {
+			write(y-lastY, "$")
+			lastY = y
+		}
+		for x := 0; x < end; {
+			count := 1
+			for x+count < end && row[x+count] == row[x] {
+				count++
+			}
+			write(count, rleTag(row[x], rule))
+			x += count
+		}
+	}
+	write(1, "!")
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// rleTag returns the letters a state is written with: b and o under a life-like rule, and . and
+// A up to yO under a Generations rule.
+func rleTag(state uint8, rule util.Rule) string {
+	switch {
+	case !rule.Generations() && state == 0:
+		return "b"
+	case !rule.Generations():
+		return "o"
+	case state == 0:
+		return "."
+	case state <= 24:
+		return string(rune('A' + state - 1))
+	default:
+		return string([]rune{rune('p' + (state-25)/24), rune('A' + (state-25)%24)})
+	}
+}
+
+// patternOf makes the smallest pattern holding the given cells, in the given states. A nil
+// states puts every cell in state 1.
+func patternOf(cells []util.Cell, states []uint8) *util.StateGrid {
+	if len(cells) == 0 {
+		return util.NewStateGrid(0, 0)
+	}
+	minX, minY, maxX, maxY := cells[0].X, cells[0].Y, cells[0].X, cells[0].Y
+	for _, cell := range cells {
+		if cell.X < minX {
+			minX = cell.X
+		}
+		if cell.X > maxX {
+			maxX = cell.X
+		}
+		if cell.Y < minY {
+			minY = cell.Y
+		}
+		if cell.Y > maxY {
+			maxY = cell.Y
+		}
+	}
+	pattern := util.NewStateGrid(maxX-minX+1, maxY-minY+1)
+	for i, cell := range cells {
+		state := uint8(1)
+		if states != nil {
+			state = states[i]
+		}
+		pattern.Set(cell.X-minX, cell.Y-minY, state)
+	}
+	return pattern
+}
+
+// decodeCells reads a pattern in the plaintext format of LifeWiki, where ! starts a comment and
+// each row is a line of . for dead cells and O for alive ones.
+func decodeCells(data []byte) (*util.StateGrid, error) {
+	var rows []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "!") {
+			continue
+		}
+		rows = append(rows, line)
+	}
+	for len(rows) > 0 && strings.TrimSpace(rows[len(rows)-1]) == "" {
+		rows = rows[:len(rows)-1]
+	}
+
+	width := 0
+	for _, row := range rows {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	pattern := util.NewStateGrid(width, len(rows))
+	for y, row := range rows {
+		for x, c := range []byte(row) {
+			switch c {
+			case '.', ' ':
+			case 'O', 'o', '*':
+				pattern.Set(x, y, 1)
+			default:
+				return nil, fmt.Errorf("cells pattern has an unexpected %q", c)
+			}
+		}
+	}
+	return pattern, nil
+}
+
+// encodeCells writes the alive cells of a world in the plaintext format of LifeWiki.
+func encodeCells(world *util.StateGrid) []byte {
+	var b bytes.Buffer
+	for y := 0; y < world.Height; y++ {
+		for _, state := range world.Row(y) {
+			if state == 1 {
+				b.WriteByte('O')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// decodeLife reads a pattern in the Life 1.05 format, which gives blocks of . and * rows after
+// #P lines with their positions, or the Life 1.06 format, which lists the x y of every alive
+// cell. A Life 1.05 file may give its rule in S/B notation on a #R line, and the rule given is
+// used when it doesn't.
+func decodeLife(data []byte, rule util.Rule) (*util.StateGrid, util.Rule, error) {
+	lines := strings.Split(string(data), "\n")
+	version := strings.TrimSpace(lines[0])
+	if version != "#Life 1.05" && version != "#Life 1.06" {
+		return nil, rule, fmt.Errorf("lif file starts with %q instead of #Life 1.05 or #Life 1.06", version)
+	}
+
+	var cells []util.Cell
+	// block is the position of the current Life 1.05 block, and y the row reached in it.
+	var block util.Cell
+	y := 0
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#P"):
+			if _, err := fmt.Sscanf(line, "#P %d %d", &block.X, &block.Y); err != nil {
+				return nil, rule, fmt.Errorf("lif block %q: %v", line, err)
+			}
+			y = 0
+		case strings.HasPrefix(line, "#R"):
+			var err error
+			if rule, err = util.ParseRule(strings.TrimSpace(line[2:])); err != nil {
+				return nil, rule, err
+			}
+		case strings.HasPrefix(line, "#N"):
+			rule = util.Life
+		case strings.HasPrefix(line, "#"):
+		case version == "#Life 1.06":
+			var cell util.Cell
+			if _, err := fmt.Sscanf(line, "%d %d", &cell.X, &cell.Y); err != nil {
+				return nil, rule, fmt.Errorf("lif cell %q: %v", line, err)
+			}
+			cells = append(cells, cell)
+		default:
+			for x, c := range []byte(line) {
+				switch c {
+				case '.':
+				case '*':
+					cells = append(cells, util.Cell{X: block.X + x, Y: block.Y + y})
+				default:
+					return nil, rule, fmt.Errorf("lif block has an unexpected %q", c)
+				}
+			}
+			y++
+		}
+	}
+	return patternOf(cells, nil), rule, nil
+}
+
+// encodeLife writes the alive cells of a world in the Life 1.06 format, placing its top left
+// cell at origin.
+func encodeLife(world *util.StateGrid, origin util.Cell) []byte {
+	var b bytes.Buffer
+	b.WriteString("#Life 1.06\n")
+	for y := 0; y < world.Height; y++ {
+		for x, state := range world.Row(y) {
+			if state == 1 {
+				fmt.Fprintf(&b, "%d %d\n", origin.X+x, origin.Y+y)
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// macrocell is a node of the quadtree in a Golly macrocell file. A node of level k covers a
+// 2^k x 2^k square. Leaves are 8x8 squares under a life-like rule, and 2x2 squares of states
+// under a Generations rule.
+type macrocell struct {
+	level    int
+	children [4]int // the nw, ne, sw and se nodes, counted from 1, or 0 for an empty square
+	cells    [8][8]uint8
+}
+
+// decodeMacrocell reads a pattern in the macrocell format of Golly, which writes out the
+// quadtree of a HashLife universe one node per line after an [M2] header. The root is the last
+// node and is centred on (0, 0). The rule is read from a #R line, and the rule given is used
+// when there isn't one.
+func decodeMacrocell(data []byte, rule util.Rule) (*util.StateGrid, util.Rule, error) {
+	lines := strings.Split(string(data), "\n")
+	if !strings.HasPrefix(lines[0], "[M2]") {
+		return nil, rule, fmt.Errorf("mc file starts with %q instead of [M2]", strings.TrimSpace(lines[0]))
+	}
+
+	nodes := []macrocell{{}}
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#R"):
+			var err error
+			if rule, err = util.ParseRule(strings.TrimSpace(line[2:])); err != nil {
+				return nil, rule, err
+			}
+		case strings.HasPrefix(line, "#"):
+		case strings.ContainsRune(".*$", rune(line[0])):
+			node := macrocell{level: 3}
+			x, y := 0, 0
+			for _, c := range line {
+				switch {
+				case c == '$':
+					x, y = 0, y+1
+				case x >= 8 || y >= 8:
+					return nil, rule, fmt.Errorf("mc leaf %q is bigger than 8x8", line)
+				case c == '*':
+					node.cells[y][x] = 1
+					x++
+				case c == '.':
+					x++
+				default:
+					return nil, rule, fmt.Errorf("mc leaf has an unexpected %q", c)
+				}
+			}
+			nodes = append(nodes, node)
+		default:
+			var node macrocell
+			var a, b, c, d int
+			if _, err := fmt.Sscanf(line, "%d %d %d %d %d", &node.level, &a, &b, &c, &d); err != nil {
+				return nil, rule, fmt.Errorf("mc node %q: %v", line, err)
+			}
+			node.children = [4]int{a, b, c, d}
+			if node.level == 1 {
+				// The children of a level 1 node are the states of its four cells.
+				node.cells = [8][8]uint8{{uint8(a), uint8(b)}, {uint8(c), uint8(d)}}
+				node.children = [4]int{}
+			} else if node.level < 1 {
+				return nil, rule, fmt.Errorf("mc node %q has a level below 1", line)
+			}
+			for _, child := range node.children {
+				if child >= len(nodes) || (child > 0 && nodes[child].level != node.level-1) {
+					return nil, rule, fmt.Errorf("mc node %q refers to a node that isn't a level below it", line)
+				}
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 1 {
+		return patternOf(nil, nil), rule, nil
+	}
+
+	var cells []util.Cell
+	var states []uint8
+	// collect lists the cells that aren't dead in node n, whose top left cell is at (x, y).
+	var collect func(n, x, y int)
+	collect = func(n, x, y int) {
+		node := nodes[n]
+		if node.level <= 3 && node.children == [4]int{} {
+			size := 1 << uint(node.level)
+			for dy := 0; dy < size; dy++ {
+				for dx := 0; dx < size; dx++ {
+					if state := node.cells[dy][dx]; state != 0 {
+						cells = append(cells, util.Cell{X: x + dx, Y: y + dy})
+						states = append(states, state)
+					}
+				}
+			}
+			return
+		}
+		half := 1 << uint(node.level-1)
+		for i, child := range node.children {
+			if child != 0 {
+				collect(child, x+half*(i%2), y+half*(i/2))
+			}
+		}
+	}
+	root := len(nodes) - 1
+	half := 1 << uint(nodes[root].level-1)
+	collect(root, -half, -half)
+
+	for i, state := range states {
+		if !rule.Generations() {
+			states[i] = 1
+		} else if int(state) >= rule.States {
+			return nil, rule, fmt.Errorf("mc pattern has state %d, but %v only has %d states", state, rule, rule.States)
+		}
+	}
+	return patternOf(cells, states), rule, nil
+}
+
+// encodeMacrocell writes a world in the macrocell format of Golly, placing its top left cell at
+// origin. Identical squares are written once, so a large world of repeating patterns is small.
+func encodeMacrocell(world *util.StateGrid, rule util.Rule, origin util.Cell) []byte {
+	// The root must reach from -half to half in both directions to hold the world.
+	level := 3
+	for half := 4; -half > origin.X || -half > origin.Y || origin.X+world.Width > half || origin.Y+world.Height > half; half *= 2 {
+		level++
+	}
+	half := 1 << uint(level-1)
+
+	var lines []string
+	index := make(map[string]int)
+	// add writes a node, unless an identical one has been written already, and returns its number.
+	add := func(line string) int {
+		if n, ok := index[line]; ok {
+			return n
+		}
+		lines = append(lines, line)
+		index[line] = len(lines)
+		return len(lines)
+	}
+	// state returns the state of the cell at (x, y) of the root.
+	state := func(x, y int) uint8 {
+		x, y = x-half-origin.X, y-half-origin.Y
+		if x < 0 || y < 0 || x >= world.Width || y >= world.Height {
+			return 0
+		}
+		return world.Get(x, y)
+	}
+	// node writes the level k square with its top left cell at (x, y) of the root, and returns its
+	// number, or 0 when it is empty.
+	var node func(k, x, y int) int
+	node = func(k, x, y int) int {
+		size := 1 << uint(k)
+		if x+size <= half+origin.X || y+size <= half+origin.Y || x >= half+origin.X+world.Width || y >= half+origin.Y+world.Height {
+			return 0
+		}
+		if k == 3 && !rule.Generations() {
+			var b strings.Builder
+			rows := 0
+			for dy := 0; dy < 8; dy++ {
+				row := ""
+				for dx := 0; dx < 8; dx++ {
+					if state(x+dx, y+dy) == 1 {
+						row += strings.Repeat(".", dx-len(row)) + "*"
+					}
+				}
+				if row != "" {
+					b.WriteString(strings.Repeat("$", dy-rows) + row + "$")
+					rows = dy + 1
+				}
+			}
+			if rows == 0 {
+				return 0
+			}
+			return add(b.String())
+		}
+		if k == 1 {
+			a, b, c, d := state(x, y), state(x+1, y), state(x, y+1), state(x+1, y+1)
+			if a == 0 && b == 0 && c == 0 && d == 0 {
+				return 0
+			}
+			return add(fmt.Sprintf("1 %d %d %d %d", a, b, c, d))
+		}
+		h := size / 2
+		nw, ne, sw, se := node(k-1, x, y), node(k-1, x+h, y), node(k-1, x, y+h), node(k-1, x+h, y+h)
+		if nw == 0 && ne == 0 && sw == 0 && se == 0 {
+			return 0
+		}
+		return add(fmt.Sprintf("%d %d %d %d %d", k, nw, ne, sw, se))
+	}
+	if node(level, 0, 0) == 0 {
+		// An empty universe is written as a single empty leaf.
+		if rule.Generations() {
+			lines = append(lines, "1 0 0 0 0")
+		} else {
+			lines = append(lines, "$")
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[M2] (gameoflife)\n#R %v\n", rule)
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// pgmFields splits a pgm file into the four fields of its header and its pixels. Only the
+// header is split on whitespace, as the grey levels of dying cells may look like it.
+func pgmFields(data []byte) []string {
+	var fields []string
+	i := 0
+	for len(fields) < 4 && i < len(data) {
+		switch {
+		case data[i] == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case strings.ContainsRune(" \t\r\n", rune(data[i])):
+			i++
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n", rune(data[i])) {
+				i++
+			}
+			fields = append(fields, string(data[start:i]))
+		}
+	}
+	// A single whitespace character separates the header from the pixels.
+	if len(fields) == 4 && i < len(data) {
+		fields = append(fields, string(data[i+1:]))
+	}
+	return fields
 }
 
 // startIo should be the entrypoint of the io goroutine.
@@ -134,9 +888,13 @@ func startIo(p Params, c ioChannels) {
 		// Block and wait for requests from the distributor
 		switch command {
 		case ioInput:
-			io.readPgmImage()
+			io.readImage()
 		case ioOutput:
-			io.writePgmImage()
+			if io.params.Format == "" || io.params.Format == PgmFormat {
+				io.writePgmImage()
+			} else {
+				io.writePatternImage()
+			}
 		case ioCheckIdle:
 			io.channels.idle <- true
 		}
@@ -1,27 +1,84 @@
+//go:build !worker
+
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"uk.ac.bris.cs/gameoflife/gol/stubs"
 	"uk.ac.bris.cs/gameoflife/util"
 )
 
 type GolMasterRunner struct{}
 
-var tickRequest = make(chan struct{}, 1)
-var currentTurns = make(chan int, 1)
-var cellCount = make(chan int, 1)
+// registry holds the worker nodes the broker distributes turns to.
+var registry = newWorkerRegistry()
+
+// pool holds the broker's connections to the workers.
+var pool = newWorkerPool()
+
+// workerTimeout is how long the broker waits for a worker before treating it as failed.
+var workerTimeout = 10 * time.Second
+
+// checkpointInterval is how many turns pass between copies of the world being collected
+// from the workers. A run rolls back to the last copy when a worker fails.
+var checkpointInterval = 100
+
+// maxSessions is how many simulations the broker runs at once.
+var maxSessions = 4
+
+// exit ends the broker once Shutdown has replied.
+var exit = os.Exit
 
 func main() {
-	// List of worker node addresses (replace with IPs or DNS of your EC2 instances)
 	pAddr := flag.String("port", "8030", "Port to listen on")
+	pWorkers := flag.String("workers", "", "Comma-separated list of worker addresses (host:port)")
+	pConfig := flag.String("config", "", "Path to a file listing one worker address per line")
+	flag.DurationVar(&workerTimeout, "timeout", workerTimeout, "How long to wait for a worker before treating it as failed")
+	flag.IntVar(&checkpointInterval, "checkpoint", checkpointInterval, "Number of turns between checkpoints of the world")
+	flag.IntVar(&maxSessions, "sessions", maxSessions, "Maximum number of simulations to run at once")
+	flag.StringVar(&stubs.Compression, "compression", stubs.Compression, "Encoding to use for worlds on connections that support it: flate or none")
 	flag.Parse()
+	if checkpointInterval < 1 {
+		log.Fatalf("Checkpoint interval must be at least 1 turn, got %d", checkpointInterval)
+	}
+	if maxSessions < 1 {
+		log.Fatalf("Session limit must be at least 1, got %d", maxSessions)
+	}
+
+	nodes, err := loadWorkerNodes(*pWorkers, *pConfig)
+	if err != nil {
+		log.Fatalf("Error loading worker list: %v", err)
+	}
+	for _, workerAddr := range nodes {
+		registry.addStatic(workerAddr)
+		if err := probeWorker(workerAddr); err != nil {
+			log.Printf("Warning: worker %s is not reachable yet: %v\n", workerAddr, err)
+		}
+	}
+	if len(nodes) == 0 {
+		log.Printf("No static workers configured, waiting for workers to register\n")
+	} else {
+		log.Printf("Using %d static workers: %v\n", len(nodes), nodes)
+	}
+	go registry.expire()
+
 	golMaster := new(GolMasterRunner)
-	err := rpc.Register(golMaster)
+	err = rpc.Register(golMaster)
 	if err != nil {
 		log.Fatalf("Error registering GolMasterRunner: %v", err)
 	}
@@ -35,6 +92,8 @@ func main() {
 
 	log.Printf("Server is listening on port %s...\n", *pAddr)
 
+	go closeOnSignal()
+
 	// Accept incoming connections and handle RPC requests
 	for {
 		conn, err := listener.Accept()
@@ -45,127 +104,1210 @@ func main() {
 
 		// Serve the connection using RPC
 		log.Printf("Connected! connection: %v", conn)
-		go rpc.ServeConn(conn)
+		go stubs.ServeConn(conn)
 	}
 }
 
-type WorkerResponse struct {
-	FinalWorld     [][]byte // The updated world from the worker
-	WorkerNumber   int
-	TurnsCompleted int // The number of turns completed by the worker
+// closeOnSignal closes the worker connections when the broker is interrupted.
+func closeOnSignal() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGTERM, syscall.SIGINT)
+	<-interrupt
+	log.Printf("Shutting down, closing worker connections\n")
+	pool.closeAll()
+	os.Exit(0)
 }
 
-func (g *GolMasterRunner) MasterStart(initReq stubs.InitialRequest, finalRes *stubs.FinalResponse) (err error) {
-	workerNodes := []string{
-		"ec2-52-204-0-223.compute-1.amazonaws.com:8040",
-		"ec2-52-205-110-39.compute-1.amazonaws.com:8040",
-		"ec2-34-198-86-17.compute-1.amazonaws.com:8040",
-		"ec2-34-199-220-125.compute-1.amazonaws.com:8040",
+// loadWorkerNodes builds the static worker list from the -workers flag, falling back to the
+// GOL_WORKERS environment variable and then to the -config file.
+func loadWorkerNodes(workersFlag string, configPath string) ([]string, error) {
+	var nodes []string
+	switch {
+	case workersFlag != "":
+		nodes = splitWorkerList(workersFlag)
+	case os.Getenv("GOL_WORKERS") != "":
+		nodes = splitWorkerList(os.Getenv("GOL_WORKERS"))
+	case configPath != "":
+		file, err := os.Open(configPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			nodes = append(nodes, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
 	}
+	return nodes, nil
+}
 
-	var wg sync.WaitGroup
-	passedWorld := initReq.NextWorld
+func splitWorkerList(list string) []string {
+	var nodes []string
+	for _, workerAddr := range strings.Split(list, ",") {
+		workerAddr = strings.TrimSpace(workerAddr)
+		if workerAddr != "" {
+			nodes = append(nodes, workerAddr)
+		}
+	}
+	return nodes
+}
+
+// workerRegistry tracks the workers known to the broker. Static workers come from the
+// command line and are never expired, registered workers must keep sending heartbeats.
+type workerRegistry struct {
+	mutex   sync.Mutex
+	workers map[string]*workerEntry
+}
+
+type workerEntry struct {
+	static   bool
+	capacity int
+	lastSeen time.Time
+}
+
+func newWorkerRegistry() *workerRegistry {
+	return &workerRegistry{workers: make(map[string]*workerEntry)}
+}
+
+func (r *workerRegistry) addStatic(workerAddr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.workers[workerAddr] = &workerEntry{static: true, capacity: 1}
+}
+
+func (r *workerRegistry) register(workerAddr string, capacity int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if entry, ok := r.workers[workerAddr]; ok {
+		entry.capacity = capacity
+		entry.lastSeen = time.Now()
+		return
+	}
+	r.workers[workerAddr] = &workerEntry{capacity: capacity, lastSeen: time.Now()}
+}
+
+func (r *workerRegistry) deregister(workerAddr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.workers, workerAddr)
+	pool.remove(workerAddr)
+}
+
+// heartbeat refreshes a registered worker and reports whether the broker still knows about it.
+func (r *workerRegistry) heartbeat(workerAddr string, capacity int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.workers[workerAddr]
+	if !ok {
+		return false
+	}
+	entry.capacity = capacity
+	entry.lastSeen = time.Now()
+	return true
+}
+
+// capacity returns the share of the world a worker declared it can take, at least 1.
+func (r *workerRegistry) capacity(workerAddr string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if entry, ok := r.workers[workerAddr]; ok && entry.capacity > 1 {
+		return entry.capacity
+	}
+	return 1
+}
+
+// fail forgets a registered worker that stopped responding. Static workers are kept,
+// since they are checked again at the start of every run.
+func (r *workerRegistry) fail(workerAddr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if entry, ok := r.workers[workerAddr]; ok && !entry.static {
+		delete(r.workers, workerAddr)
+	}
+	pool.remove(workerAddr)
+}
+
+// healthy returns the workers that can be used for a new run, in a stable order,
+// along with any static workers that could not be reached.
+func (r *workerRegistry) healthy() (workerNodes []string, unreachable []string) {
+	r.mutex.Lock()
+	var static []string
+	for workerAddr, entry := range r.workers {
+		if entry.static {
+			static = append(static, workerAddr)
+		} else if time.Since(entry.lastSeen) < stubs.HeartbeatTimeout {
+			workerNodes = append(workerNodes, workerAddr)
+		}
+	}
+	r.mutex.Unlock()
+
+	// Static workers don't send heartbeats, so check them directly.
+	for _, workerAddr := range static {
+		if err := probeWorker(workerAddr); err != nil {
+			unreachable = append(unreachable, workerAddr)
+		} else {
+			workerNodes = append(workerNodes, workerAddr)
+		}
+	}
+	sort.Strings(workerNodes)
+	return
+}
+
+// expire keeps dropping registered workers that have stopped sending heartbeats.
+func (r *workerRegistry) expire() {
+	ticker := time.NewTicker(stubs.HeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.expireStale()
+	}
+}
+
+// expireStale drops the registered workers whose last heartbeat is older than stubs.HeartbeatTimeout.
+func (r *workerRegistry) expireStale() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for workerAddr, entry := range r.workers {
+		if !entry.static && time.Since(entry.lastSeen) >= stubs.HeartbeatTimeout {
+			delete(r.workers, workerAddr)
+			pool.remove(workerAddr)
+			log.Printf("Worker %s missed its heartbeats, removing it\n", workerAddr)
+		}
+	}
+}
+
+// probeWorker checks that a worker is accepting connections.
+func probeWorker(workerAddr string) error {
+	conn, err := net.DialTimeout("tcp", workerAddr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (g *GolMasterRunner) MasterStart(initReq stubs.InitialRequest, startRes *stubs.StartResponse) (err error) {
+	workerNodes, unreachable := registry.healthy()
+	if len(workerNodes) == 0 {
+		if len(unreachable) > 0 {
+			return fmt.Errorf("no healthy workers, unreachable: %s", strings.Join(unreachable, ", "))
+		}
+		return errors.New("no workers registered with the broker")
+	}
+
+	if err = checkWorld(&initReq); err != nil {
+		return
+	}
+
+	session, err := newSession(initReq)
+	if err != nil {
+		return
+	}
+	log.Printf("Starting session %s (%dx%d, %d turns, %v on a %v) across %d workers: %v\n",
+		session.ID, initReq.Width, initReq.Height, initReq.Turns, initReq.Rule, initReq.Topology, len(workerNodes), workerNodes)
+	go session.run(initReq, workerNodes)
+
+	startRes.SessionID = session.ID
+	return
+}
+
+// checkWorld makes sure the world of a request matches its width and height. Requests from
+// controllers that leave the size out take it from the world itself.
+func checkWorld(initReq *stubs.InitialRequest) error {
+	world := initReq.NextWorld
+	if world == nil {
+		return errors.New("no world received")
+	}
+	if initReq.Width == 0 && initReq.Height == 0 {
+		initReq.Width, initReq.Height = world.Width, world.Height
+	}
+	if initReq.Width <= 0 || initReq.Height <= 0 {
+		return fmt.Errorf("invalid world size %dx%d", initReq.Width, initReq.Height)
+	}
+	if world.Width != initReq.Width || world.Height != initReq.Height {
+		return fmt.Errorf("the world is %dx%d, expected %dx%d", world.Width, world.Height, initReq.Width, initReq.Height)
+	}
+	if len(world.Words) != util.WordsPerRow(world.Width)*world.Height {
+		return fmt.Errorf("the world has %d words, expected %d", len(world.Words), util.WordsPerRow(world.Width)*world.Height)
+	}
+	if initReq.Rule == (util.Rule{}) {
+		initReq.Rule = util.Life
+	}
+	if initReq.Rule.Generations() {
+		return fmt.Errorf("the Generations rule %v can only be run locally", initReq.Rule)
+	}
+	if initReq.Topology < util.Torus || initReq.Topology > util.CrossSurface {
+		return fmt.Errorf("unknown topology %v", initReq.Topology)
+	}
+	return nil
+}
+
+// Session is a single run of the Game of Life on the broker. The turn loop publishes its
+// progress here after every turn, so RPCs can answer without waiting for the loop.
+type Session struct {
+	ID         string
+	skipFrames bool
+
+	mutex      sync.Mutex
+	turn       int
+	turns      int
+	aliveCount int
+	paused     bool
+	attached   bool
+	failures   []string
+	result     stubs.FinalResponse
+	finishedAt time.Time
+
+	// events holds the progress updates the attached controller has not acknowledged yet.
+	// events[0] has the sequence number eventsBase.
+	events     []stubs.SessionEvent
+	eventsBase int
+	eventsSent int           // sequence number of the last event handed to the controller
+	changed    chan struct{} // closed and replaced whenever events are added or acknowledged
+
+	controls chan controlRequest
+	done     chan struct{}
+}
+
+var sessionsMutex sync.Mutex
+var sessions = make(map[string]*Session)
+var latestSession *Session
+
+// sessionRetention is how long a finished session's result is kept for Wait and TickTime.
+const sessionRetention = 10 * time.Minute
+
+// maxQueuedEvents is how far the attached controller may fall behind before the turn loop waits for it.
+const maxQueuedEvents = 256
+
+// controllerTimeout is how long the turn loop waits for a controller that stopped polling
+// before carrying on without it.
+const controllerTimeout = 10 * time.Second
+
+// pollTimeout is how long PollEvents waits for new events before returning an empty batch.
+const pollTimeout = time.Second
+
+// aliveInterval is how often the alive cell count is reported to the controller.
+const aliveInterval = 2 * time.Second
+
+// lastID is the most recent number handed out by nextID.
+var lastID int64
+
+// nextID returns a number no other session or run on this broker has used.
+func nextID() int64 {
+	return atomic.AddInt64(&lastID, 1)
+}
+
+// newSession registers a session for a new run. Sessions share the workers, so a run is
+// refused while maxSessions others are still going.
+func newSession(initReq stubs.InitialRequest) (*Session, error) {
+	session := &Session{
+		ID:         strconv.FormatInt(nextID(), 10),
+		skipFrames: initReq.SkipFrames,
+		turns:      initReq.Turns,
+		aliveCount: initReq.NextWorld.PopCount(),
+		attached:   true,
+		eventsBase: 1,
+		changed:    make(chan struct{}),
+		controls:   make(chan controlRequest),
+		done:       make(chan struct{}),
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	running := 0
+	for id, old := range sessions {
+		if !old.finished() {
+			running++
+		} else if time.Since(old.finishedAt) > sessionRetention {
+			delete(sessions, id)
+		}
+	}
+	if running >= maxSessions {
+		return nil, fmt.Errorf("the broker is already running %d sessions, stop one before starting another", running)
+	}
+	sessions[session.ID] = session
+	latestSession = session
+	return session, nil
+}
+
+// getSession looks up a session by ID. An empty ID means the most recently started session.
+func getSession(id string) (*Session, error) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if id == "" {
+		if latestSession == nil {
+			return nil, errors.New("no session has been started")
+		}
+		return latestSession, nil
+	}
+	session, ok := sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown session %s", id)
+	}
+	return session, nil
+}
+
+// runningSessions returns every session whose turn loop has not finished.
+func runningSessions() []*Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	var running []*Session
+	for _, session := range sessions {
+		if !session.finished() {
+			running = append(running, session)
+		}
+	}
+	return running
+}
+
+func (s *Session) finished() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// publish records the progress of the turn loop.
+func (s *Session) publish(turn int, aliveCount int, paused bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.turn = turn
+	s.aliveCount = aliveCount
+	s.paused = paused
+}
+
+// emit queues an event for the attached controller. Events are dropped while no controller is attached.
+func (s *Session) emit(event stubs.SessionEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.attached {
+		return
+	}
+	s.events = append(s.events, event)
+	s.notify()
+}
+
+// emitTurn queues the cells flipped by a turn followed by its TurnComplete. When frames may be skipped
+// and the controller has fallen behind, the turn is merged into the last queued one instead.
+func (s *Session) emitTurn(turn int, flipped []util.Cell) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.attached {
+		return
+	}
+
+	n := len(s.events)
+	last := s.eventsBase + n - 1
+	if s.skipFrames && n >= maxQueuedEvents && last-1 > s.eventsSent &&
+		s.events[n-2].Kind == stubs.CellsFlippedEvent && s.events[n-1].Kind == stubs.TurnCompleteEvent {
+		s.events[n-2].Cells = mergeFlipped(s.events[n-2].Cells, flipped)
+		s.events[n-2].Turn = turn
+		s.events[n-1].Turn = turn
+		return
+	}
+	s.events = append(s.events,
+		stubs.SessionEvent{Kind: stubs.CellsFlippedEvent, Turn: turn, Cells: flipped},
+		stubs.SessionEvent{Kind: stubs.TurnCompleteEvent, Turn: turn})
+	s.notify()
+}
+
+// mergeFlipped combines the flipped cells of two turns. A cell flipped in both turns is back where it started.
+func mergeFlipped(first []util.Cell, second []util.Cell) []util.Cell {
+	flipped := make(map[util.Cell]bool, len(first)+len(second))
+	for _, cell := range first {
+		flipped[cell] = true
+	}
+	for _, cell := range second {
+		if flipped[cell] {
+			delete(flipped, cell)
+		} else {
+			flipped[cell] = true
+		}
+	}
+	merged := make([]util.Cell, 0, len(flipped))
+	for cell := range flipped {
+		merged = append(merged, cell)
+	}
+	return merged
+}
+
+// watched reports whether a controller is attached to the session.
+func (s *Session) watched() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.attached
+}
+
+// notify wakes everything waiting on the event queue. The caller must hold the mutex.
+func (s *Session) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// acknowledge drops every queued event up to and including sequence number last.
+// The caller must hold the mutex.
+func (s *Session) acknowledge(last int) {
+	n := last - s.eventsBase + 1
+	if n <= 0 {
+		return
+	}
+	if n > len(s.events) {
+		n = len(s.events)
+	}
+	s.events = s.events[n:]
+	s.eventsBase += n
+	s.notify()
+}
+
+// setAttached attaches or detaches the controller, starting it from an empty event queue.
+func (s *Session) setAttached(attached bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attached = attached
+	s.acknowledge(s.eventsBase + len(s.events) - 1)
+}
+
+// backlog returns a channel to wait on if the attached controller has fallen too far
+// behind, or nil if the turn loop may carry on.
+func (s *Session) backlog() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.attached || len(s.events) < maxQueuedEvents {
+		return nil
+	}
+	return s.changed
+}
+
+// recordFailure removes a failed worker from the registry and queues it to be
+// reported to the controller. A worker that is still alive will register again.
+func (s *Session) recordFailure(workerAddr string, turn int) {
+	registry.fail(workerAddr)
+	s.mutex.Lock()
+	s.failures = append(s.failures, workerAddr)
+	s.mutex.Unlock()
+	s.emit(stubs.SessionEvent{Kind: stubs.WorkerFailedEvent, Turn: turn, Worker: workerAddr})
+}
+
+// run is the turn loop of a session. It keeps the strips moving on the workers and serves
+// control requests between turns.
+func (s *Session) run(initReq stubs.InitialRequest, workerNodes []string) {
 	passedTurns := initReq.Turns
-	passedThreads := len(workerNodes)
-	sizeOfWorld := len(passedWorld)
-	responseChannels := make([]chan [][]uint8, passedThreads)
-	for i := 0; i < passedThreads; i++ {
-		responseChannels[i] = make(chan [][]uint8)
+	liveWorkers := append([]string{}, workerNodes...)
+	run := nextID()
+
+	world := initReq.NextWorld
+	turn := 0
+	aliveCount := world.PopCount()
+	checkpoint, checkpointTurn := world, 0
+
+	strips := newStripSet(run, world, initReq.ThreadCount, initReq.Rule, initReq.Topology, liveWorkers)
+	failed := strips.load(world)
+
+	// Turns replayed after a rollback have already been reported to the controller.
+	reported := 0
+	aliveReported := time.Now()
+
+	paused := false
+	stopped := false
+	var stopReply chan controlReply
+	handle := func(req controlRequest) {
+		res := stubs.ControlResponse{SessionID: s.ID, Turn: turn}
+		var err error
+		switch req.action {
+		case pauseAction:
+			paused = true
+			s.emit(stubs.SessionEvent{Kind: stubs.StateChangeEvent, Turn: turn, Paused: true})
+			log.Printf("Session %s paused at turn %d\n", s.ID, turn)
+		case resumeAction:
+			paused = false
+			s.emit(stubs.SessionEvent{Kind: stubs.StateChangeEvent, Turn: turn, Paused: false})
+			log.Printf("Session %s resumed at turn %d\n", s.ID, turn)
+		case snapshotAction, attachAction:
+			res.World = world
+			if strips != nil {
+				res.World, failed = strips.collect()
+				if len(failed) > 0 {
+					err = errors.New("a worker failed while taking the snapshot")
+				}
+			}
+			if req.action == attachAction && err == nil {
+				// Attach here so the new controller sees every event after the world it is handed.
+				s.setAttached(true)
+				res.Turns = passedTurns
+				res.Paused = paused
+				res.Rule = initReq.Rule
+				res.Topology = initReq.Topology
+				log.Printf("Controller attached to session %s at turn %d\n", s.ID, turn)
+			}
+		case stopAction:
+			// Reply once the run has wound down and released its strips.
+			stopped = true
+			stopReply = req.reply
+			return
+		}
+		s.publish(turn, aliveCount, paused)
+		req.reply <- controlReply{res, err}
 	}
 
-	for localTurns := 0; localTurns < passedTurns; localTurns++ {
+	for {
+		if len(failed) > 0 {
+			// Strips held by a failed worker are lost, so restart every strip from the last checkpoint.
+			for _, workerAddr := range failed {
+				log.Printf("Worker %s failed at turn %d, rolling back to turn %d\n", workerAddr, turn, checkpointTurn)
+				liveWorkers = dropWorker(liveWorkers, workerAddr)
+				s.recordFailure(workerAddr, turn)
+			}
+			strips.release()
+			strips = nil
+			failed = nil
+			world, turn = checkpoint, checkpointTurn
+			aliveCount = world.PopCount()
+			s.publish(turn, aliveCount, paused)
+
+			if len(liveWorkers) > 0 {
+				strips = newStripSet(run, world, initReq.ThreadCount, initReq.Rule, initReq.Topology, liveWorkers)
+				failed = strips.load(world)
+				continue
+			}
+			log.Printf("No workers left, computing the rest of session %s on the broker\n", s.ID)
+		}
+
+		// Serve control requests between turns, and block here while paused.
 		select {
-		case <-tickRequest:
-			go func() {
-				currentTurns <- localTurns // Directly use localTurns
-				cellCount <- len(calculateAliveCells(passedWorld))
-				return
-			}()
+		case req := <-s.controls:
+			handle(req)
 		default:
 		}
+		for wait := s.backlog(); wait != nil && !stopped && !s.skipFrames; wait = s.backlog() {
+			select {
+			case req := <-s.controls:
+				handle(req)
+			case <-wait:
+			case <-time.After(controllerTimeout):
+				log.Printf("Controller of session %s stopped polling, carrying on without it\n", s.ID)
+				s.setAttached(false)
+			}
+		}
+		for paused && !stopped && len(failed) == 0 {
+			handle(<-s.controls)
+		}
+		if len(failed) > 0 {
+			continue
+		}
 
-		newWorld := make([][]byte, sizeOfWorld)
-		for j := range newWorld {
-			newWorld[j] = make([]byte, sizeOfWorld)
+		if turn == passedTurns || stopped {
+			if strips != nil {
+				world, failed = strips.collect()
+				if len(failed) > 0 {
+					continue
+				}
+				strips.release()
+			}
+			break
 		}
 
-		for k, workerAddr := range workerNodes {
-			if workerAddr == "" {
-				log.Printf("Worker address is empty. Skipping worker %d.\n", k)
+		// Diffs are only worth computing while a controller is watching.
+		watched := s.watched()
+		var flipped []util.Cell
+		if strips == nil {
+			nextWorld := calculateNextState(world, initReq.Rule, initReq.Topology)
+			if watched {
+				flipped = world.FlippedCells(nextWorld, 0)
+			}
+			world = nextWorld
+			aliveCount = world.PopCount()
+		} else {
+			aliveCount, flipped, failed = strips.step(watched)
+			if len(failed) > 0 {
 				continue
 			}
+		}
+		turn++
+		s.publish(turn, aliveCount, paused)
 
-			wg.Add(1)
-			go func(workerAddr string, index int) {
-				defer wg.Done()
-				client2, err := rpc.Dial("tcp", workerAddr)
-				if err != nil {
-					log.Printf("Failed to connect to worker %d: %v\n", index, err)
-					return
-				}
-
-				req := stubs.Request{
-					WorkerNumber: index,
-					NextWorld:    passedWorld,
-					Turns:        passedTurns,
-					ThreadCount:  passedThreads,
-				}
-				res := new(stubs.Response)
-				if err := client2.Call(stubs.StartWorker, req, res); err != nil {
-					log.Printf("Error in worker %d RPC call: %v\n", index, err)
-					return
-				}
-				responseChannels[index] <- res.FinalWorld
-			}(workerAddr, k)
+		if turn > reported {
+			reported = turn
+			s.emitTurn(turn, flipped)
+			if time.Since(aliveReported) >= aliveInterval {
+				aliveReported = time.Now()
+				s.emit(stubs.SessionEvent{Kind: stubs.AliveCellsCountEvent, Turn: turn, AliveCount: aliveCount})
+			}
 		}
 
-		for j := 0; j < passedThreads; j++ {
-			if j < len(responseChannels) {
-				receivedWorld := <-responseChannels[j]
-				for y := j * sizeOfWorld / passedThreads; y < (j+1)*sizeOfWorld/passedThreads; y++ {
-					for x := 0; x < sizeOfWorld; x++ {
-						newWorld[y][x] = receivedWorld[y][x]
-					}
-				}
+		if strips != nil && turn%checkpointInterval == 0 {
+			var collected *util.BitGrid
+			collected, failed = strips.collect()
+			if len(failed) == 0 {
+				checkpoint, checkpointTurn = collected, turn
 			}
 		}
+	}
+
+	s.mutex.Lock()
+	s.turn = turn
+	s.aliveCount = world.PopCount()
+	s.paused = false
+	s.result = stubs.FinalResponse{
+		FinalWorld:     world,
+		AliveCells:     world.AliveCells(0),
+		TurnsCompleted: turn,
+	}
+	s.finishedAt = time.Now()
+	s.mutex.Unlock()
+	close(s.done)
+	log.Printf("Session %s finished at turn %d\n", s.ID, turn)
+
+	if stopReply != nil {
+		stopReply <- controlReply{res: stubs.ControlResponse{SessionID: s.ID, Turn: turn}}
+	}
+}
+
+// controlRequest asks the turn loop of a session to act on a keypress from the controller.
+type controlRequest struct {
+	action int
+	reply  chan controlReply
+}
+
+type controlReply struct {
+	res stubs.ControlResponse
+	err error
+}
+
+const (
+	pauseAction = iota
+	resumeAction
+	snapshotAction
+	attachAction
+	stopAction
+)
+
+// control passes a request to the turn loop and waits for it to be handled.
+func (s *Session) control(action int) (stubs.ControlResponse, error) {
+	req := controlRequest{action: action, reply: make(chan controlReply, 1)}
+	select {
+	case s.controls <- req:
+	case <-s.done:
+		return stubs.ControlResponse{}, fmt.Errorf("session %s has finished", s.ID)
+	}
+	reply := <-req.reply
+	return reply.res, reply.err
+}
+
+// controlSession looks up the session of a control request and passes it the action.
+func controlSession(req stubs.ControlRequest, action int) (stubs.ControlResponse, error) {
+	session, err := getSession(req.SessionID)
+	if err != nil {
+		return stubs.ControlResponse{}, err
+	}
+	return session.control(action)
+}
+
+func (g *GolMasterRunner) Pause(req stubs.ControlRequest, res *stubs.ControlResponse) (err error) {
+	*res, err = controlSession(req, pauseAction)
+	return
+}
+
+func (g *GolMasterRunner) Resume(req stubs.ControlRequest, res *stubs.ControlResponse) (err error) {
+	*res, err = controlSession(req, resumeAction)
+	return
+}
+
+func (g *GolMasterRunner) Snapshot(req stubs.ControlRequest, res *stubs.ControlResponse) (err error) {
+	*res, err = controlSession(req, snapshotAction)
+	return
+}
+
+// Attach hands a new controller the current world of a session in progress, so it can take over
+// from a controller that detached. An empty session ID picks the most recent session.
+func (g *GolMasterRunner) Attach(req stubs.ControlRequest, res *stubs.ControlResponse) (err error) {
+	*res, err = controlSession(req, attachAction)
+	return
+}
 
-		passedWorld = newWorld
+// PollEvents waits until a session has events queued after req.After and returns them.
+// Passing the sequence number of the last event received acknowledges it and everything before it.
+func (g *GolMasterRunner) PollEvents(req stubs.PollRequest, res *stubs.PollResponse) (err error) {
+	session, err := getSession(req.SessionID)
+	if err != nil {
+		return
 	}
+	timeout := time.After(pollTimeout)
 
-	// Wait for all goroutines to finish and close channels
-	go func() {
-		wg.Wait()
-		for _, ch := range responseChannels {
-			close(ch)
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.acknowledge(req.After)
+	res.Last = req.After
+	for len(session.events) == 0 {
+		if session.finished() {
+			res.Finished = true
+			return
+		}
+		changed := session.changed
+		session.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-session.done:
+		case <-timeout:
+			session.mutex.Lock()
+			return
 		}
-	}()
+		session.mutex.Lock()
+	}
+	res.Events = append([]stubs.SessionEvent{}, session.events...)
+	res.Last = session.eventsBase + len(session.events) - 1
+	session.eventsSent = res.Last
+	return
+}
+
+// Wait blocks until a session finishes and returns its result.
+func (g *GolMasterRunner) Wait(req stubs.ControlRequest, finalRes *stubs.FinalResponse) (err error) {
+	session, err := getSession(req.SessionID)
+	if err != nil {
+		return
+	}
+	<-session.done
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	*finalRes = session.result
+	finalRes.FailedWorkers = session.failures
+	session.failures = nil
+	return
+}
+
+// Detach lets the controller leave while the session carries on without it.
+func (g *GolMasterRunner) Detach(req stubs.ControlRequest, res *stubs.ControlResponse) (err error) {
+	session, err := getSession(req.SessionID)
+	if err != nil {
+		return
+	}
+	session.setAttached(false)
 
-	finalRes.FinalWorld = passedWorld
-	finalRes.AliveCells = calculateAliveCells(passedWorld)
-	finalRes.TurnsCompleted = initReq.Turns
+	session.mutex.Lock()
+	res.SessionID = session.ID
+	res.Turn = session.turn
+	session.mutex.Unlock()
+	log.Printf("Controller detached from session %s, it continues\n", session.ID)
 	return
 }
 
-func (g *GolMasterRunner) TickTime(aliveRequest *stubs.AliveRequest, aliveCellResponse *stubs.AliveResponse) (err error) {
-	tickRequest <- struct{}{}
-	currentTurn2 := <-currentTurns
-	cellCount2 := <-cellCount
-	aliveCellResponse.AliveCellCount = cellCount2
-	aliveCellResponse.CurrentTurns = currentTurn2
+// Shutdown stops every session, shuts down every known worker and then the broker itself.
+func (g *GolMasterRunner) Shutdown(req stubs.ControlRequest, res *stubs.ControlResponse) (err error) {
+	for _, session := range runningSessions() {
+		stopped, err := session.control(stopAction)
+		if err == nil && session.ID == req.SessionID {
+			*res = stopped
+		}
+	}
+
+	workerNodes, _ := registry.healthy()
+	for _, workerAddr := range workerNodes {
+		if err := callWorker(workerAddr, stubs.ShutdownWorker, stubs.ControlRequest{}, new(stubs.ControlResponse)); err != nil {
+			log.Printf("Error shutting down worker %s: %v\n", workerAddr, err)
+		}
+	}
+
+	log.Printf("Shutting down\n")
+	// Give the reply a moment to reach the controller before exiting.
+	time.AfterFunc(100*time.Millisecond, func() {
+		pool.closeAll()
+		exit(0)
+	})
 	return
 }
 
-func calculateAliveCells(world [][]byte) []util.Cell {
-	size := len(world)
-	aliveCollection := []util.Cell{}
-	for y := 0; y < size; y++ { // Iterate over rows (height)
-		for x := 0; x < size; x++ { // Iterate over columns (width)
-			if world[y][x] == 255 { // Access as world[row][column] or world[y][x]
-				alive := util.Cell{x, y}
-				aliveCollection = append(aliveCollection, alive)
+// stripSet tracks the strips of a run while they are held by the workers. The broker
+// only keeps the edge rows of each strip, which it passes on as halos every turn.
+type stripSet struct {
+	run      int64
+	width    int
+	threads  int // goroutines each worker uses for its strip
+	rule     util.Rule
+	topology util.Topology
+	bounds   []int // strip j covers rows bounds[j] up to bounds[j+1]
+	owners   []string
+	tops     [][]uint64
+	bottoms  [][]uint64
+	west     []uint64 // the west and east columns of the world, when the topology twists those edges
+	east     []uint64
+}
+
+// stripCounts tracks how many strips each worker holds across every session, so that
+// sessions too small to use every worker are placed on the least loaded ones.
+var stripCountsMutex sync.Mutex
+var stripCounts = make(map[string]int)
+
+// newStripSet splits the world into one strip per worker, or one per row if the world is smaller.
+// Each worker's strip is sized in proportion to its declared capacity.
+func newStripSet(run int64, world *util.BitGrid, threads int, rule util.Rule, topology util.Topology, workerNodes []string) *stripSet {
+	height := world.Height
+	count := len(workerNodes)
+	if count > height {
+		count = height
+	}
+
+	stripCountsMutex.Lock()
+	defer stripCountsMutex.Unlock()
+	ordered := append([]string{}, workerNodes...)
+	sort.SliceStable(ordered, func(a, b int) bool {
+		return stripCounts[ordered[a]] < stripCounts[ordered[b]]
+	})
+
+	s := &stripSet{
+		run:      run,
+		width:    world.Width,
+		threads:  threads,
+		rule:     rule,
+		topology: topology,
+		owners:   make([]string, count),
+		tops:     make([][]uint64, count),
+		bottoms:  make([][]uint64, count),
+	}
+	weights := make([]int, count+1)
+	for j := 0; j < count; j++ {
+		s.owners[j] = ordered[j]
+		stripCounts[ordered[j]]++
+		weights[j+1] = weights[j] + registry.capacity(ordered[j])
+	}
+	s.bounds = partition(height, weights)
+	return s
+}
+
+// partition splits height rows into strips in proportion to the cumulative weights, keeping at
+// least one row in every strip. It returns the first row of each strip followed by height.
+func partition(height int, weights []int) []int {
+	count := len(weights) - 1
+	total := weights[count]
+	bounds := make([]int, count+1)
+	for j := 1; j <= count; j++ {
+		bounds[j] = height * weights[j] / total
+		if bounds[j] <= bounds[j-1] {
+			bounds[j] = bounds[j-1] + 1
+		}
+		if last := height - (count - j); bounds[j] > last {
+			bounds[j] = last
+		}
+	}
+	return bounds
+}
+
+func (s *stripSet) id(j int) stubs.StripID {
+	return stubs.StripID{Run: s.run, Index: j}
+}
+
+// each runs f for every strip in parallel and returns the workers that failed.
+func (s *stripSet) each(f func(j int) error) []string {
+	errs := make([]error, len(s.owners))
+	var wg sync.WaitGroup
+	for j := range s.owners {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			errs[j] = f(j)
+		}(j)
+	}
+	wg.Wait()
+
+	var failed []string
+	for j, err := range errs {
+		if err != nil {
+			log.Printf("Error on strip %d of worker %s: %v\n", j, s.owners[j], err)
+			if len(dropWorker(failed, s.owners[j])) == len(failed) {
+				failed = append(failed, s.owners[j])
+			}
+		}
+	}
+	return failed
+}
+
+// load sends every strip of the world to its worker.
+func (s *stripSet) load(world *util.BitGrid) []string {
+	for j := range s.owners {
+		s.tops[j] = world.Row(s.bounds[j])
+		s.bottoms[j] = world.Row(s.bounds[j+1] - 1)
+	}
+	if s.topology.TwistsX() {
+		s.west = world.Column(0)
+		s.east = world.Column(world.Width - 1)
+	}
+	return s.each(func(j int) error {
+		req := stubs.StripRequest{ID: s.id(j), StartY: s.bounds[j], EndY: s.bounds[j+1], Width: s.width, Rows: world.Rows(s.bounds[j], s.bounds[j+1]), Rule: s.rule, Topology: s.topology}
+		return callWorker(s.owners[j], stubs.LoadStrip, req, new(stubs.StripResponse))
+	})
+}
+
+// step advances every strip by one turn, exchanging halo rows between neighbouring strips.
+// The cells that changed state are only gathered when flipped is set.
+func (s *stripSet) step(flipped bool) (int, []util.Cell, []string) {
+	count := len(s.owners)
+	responses := make([]stubs.HaloResponse, count)
+	failed := s.each(func(j int) error {
+		req := stubs.HaloRequest{
+			ID:      s.id(j),
+			Top:     s.bottoms[(j-1+count)%count],
+			Bottom:  s.tops[(j+1)%count],
+			Flipped: flipped,
+			Threads: s.threads,
+		}
+		// The halos of the first and last strips come from across the top and bottom edges.
+		if j == 0 {
+			req.Top = s.across(req.Top)
+		}
+		if j == count-1 {
+			req.Bottom = s.across(req.Bottom)
+		}
+		if s.topology.TwistsX() {
+			req.West, req.East = s.beyondX(j)
+		}
+		return callWorker(s.owners[j], stubs.StepStrip, req, &responses[j])
+	})
+	if len(failed) > 0 {
+		return 0, nil, failed
+	}
+
+	aliveCount := 0
+	var cells []util.Cell
+	for j, res := range responses {
+		s.tops[j] = res.Top
+		s.bottoms[j] = res.Bottom
+		if s.topology.TwistsX() {
+			for y := s.bounds[j]; y < s.bounds[j+1]; y++ {
+				util.SetRowCell(s.west, y, util.RowCell(res.West, y-s.bounds[j]))
+				util.SetRowCell(s.east, y, util.RowCell(res.East, y-s.bounds[j]))
 			}
 		}
+		aliveCount += res.AliveCount
+		cells = append(cells, res.Flipped...)
+	}
+	return aliveCount, cells, nil
+}
+
+// across returns an edge row of the world as seen from across the top or bottom edge.
+func (s *stripSet) across(row []uint64) []uint64 {
+	if across := s.topology.AcrossY(row, s.width); across != nil {
+		return across
+	}
+	return make([]uint64, util.WordsPerRow(s.width))
+}
+
+// beyondX returns the cells just beyond the west and east edges of strip j, from the row above
+// the strip to the row below it. Leaving the world across the west or east edge comes back in
+// on the mirrored row of the other edge, and beyond a corner every cell is dead.
+func (s *stripSet) beyondX(j int) ([]uint64, []uint64) {
+	height := s.bounds[len(s.owners)]
+	rows := s.bounds[j+1] - s.bounds[j] + 2
+	west := make([]uint64, util.WordsPerRow(rows))
+	east := make([]uint64, util.WordsPerRow(rows))
+	for i := 0; i < rows; i++ {
+		y := s.bounds[j] - 1 + i
+		if y < 0 || y >= height {
+			continue
+		}
+		util.SetRowCell(west, i, util.RowCell(s.east, height-1-y))
+		util.SetRowCell(east, i, util.RowCell(s.west, height-1-y))
+	}
+	return west, east
+}
+
+// collect gathers the full world from the workers.
+func (s *stripSet) collect() (*util.BitGrid, []string) {
+	world := util.NewBitGrid(s.width, s.bounds[len(s.owners)])
+	failed := s.each(func(j int) error {
+		res := new(stubs.StripResponse)
+		if err := callWorker(s.owners[j], stubs.CollectStrip, stubs.StripRequest{ID: s.id(j)}, res); err != nil {
+			return err
+		}
+		rows := world.Rows(s.bounds[j], s.bounds[j+1])
+		if res.Rows == nil || len(res.Rows.Words) != len(rows.Words) {
+			return fmt.Errorf("expected %d rows of %d cells", rows.Height, rows.Width)
+		}
+		copy(rows.Words, res.Rows.Words)
+		return nil
+	})
+	return world, failed
+}
+
+// release tells the workers they can forget their strips. Failures are ignored,
+// a worker that cannot be reached has already lost its strip.
+func (s *stripSet) release() {
+	s.each(func(j int) error {
+		_ = callWorker(s.owners[j], stubs.DropStrip, stubs.StripRequest{ID: s.id(j)}, new(stubs.StripResponse))
+		return nil
+	})
+
+	stripCountsMutex.Lock()
+	defer stripCountsMutex.Unlock()
+	for _, workerAddr := range s.owners {
+		if stripCounts[workerAddr]--; stripCounts[workerAddr] <= 0 {
+			delete(stripCounts, workerAddr)
+		}
+	}
+}
+
+// resendable holds the worker calls that are safe to send twice. StepStrip is not one of them,
+// since a worker may have stepped its strip before the connection broke, and stepping it again
+// would leave the strip a turn ahead of its neighbours.
+var resendable = map[string]bool{
+	stubs.LoadStrip:    true,
+	stubs.CollectStrip: true,
+	stubs.DropStrip:    true,
+}
+
+// callWorker makes an RPC call to a worker over its pooled connection, giving up after workerTimeout.
+// A broken connection is replaced, and resendable calls are retried once on the new connection
+// before the worker is treated as failed.
+func callWorker(workerAddr string, method string, req interface{}, res interface{}) error {
+	for attempt := 0; ; attempt++ {
+		client, err := pool.get(workerAddr)
+		if err != nil {
+			return err
+		}
+
+		call := client.Go(method, req, res, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(workerTimeout):
+			// Other sessions share the connection, so it is left open. It is closed once the
+			// worker is dropped from the registry as failed.
+			return fmt.Errorf("no response after %v", workerTimeout)
+		}
+
+		if _, isServerError := err.(rpc.ServerError); err == nil || isServerError {
+			return err
+		}
+		pool.discard(workerAddr, client)
+		if attempt > 0 || !resendable[method] {
+			return err
+		}
 	}
-	return aliveCollection
+}
+
+// workerPool keeps one long-lived RPC connection per worker, shared by every call to it.
+type workerPool struct {
+	mutex   sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func newWorkerPool() *workerPool {
+	return &workerPool{clients: make(map[string]*rpc.Client)}
+}
+
+// get returns the connection to a worker, dialling it if there isn't one yet.
+func (p *workerPool) get(workerAddr string) (*rpc.Client, error) {
+	p.mutex.Lock()
+	client, ok := p.clients[workerAddr]
+	p.mutex.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	// Dial without holding the lock so a slow worker doesn't hold up calls to the others.
+	client, err := stubs.Dial(workerAddr, workerTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if existing, ok := p.clients[workerAddr]; ok {
+		client.Close()
+		return existing, nil
+	}
+	p.clients[workerAddr] = client
+	return client, nil
+}
+
+// discard closes a broken connection so the next call dials a fresh one.
+func (p *workerPool) discard(workerAddr string, client *rpc.Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.clients[workerAddr] == client {
+		delete(p.clients, workerAddr)
+	}
+	client.Close()
+}
+
+// remove closes the connection to a worker that has left the broker.
+func (p *workerPool) remove(workerAddr string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if client, ok := p.clients[workerAddr]; ok {
+		delete(p.clients, workerAddr)
+		client.Close()
+	}
+}
+
+// closeAll closes every pooled connection when the broker shuts down.
+func (p *workerPool) closeAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for workerAddr, client := range p.clients {
+		client.Close()
+		delete(p.clients, workerAddr)
+	}
+}
+
+func dropWorker(workerNodes []string, workerAddr string) []string {
+	remaining := []string{}
+	for _, addr := range workerNodes {
+		if addr != workerAddr {
+			remaining = append(remaining, addr)
+		}
+	}
+	return remaining
+}
+
+func (g *GolMasterRunner) RegisterWorker(req stubs.WorkerRequest, res *stubs.WorkerResponse) (err error) {
+	if req.Address == "" {
+		return errors.New("no worker address received")
+	}
+	registry.register(req.Address, req.Capacity)
+	log.Printf("Worker %s registered with capacity %d\n", req.Address, req.Capacity)
+	res.Registered = true
+	return
+}
+
+func (g *GolMasterRunner) DeregisterWorker(req stubs.WorkerRequest, res *stubs.WorkerResponse) (err error) {
+	registry.deregister(req.Address)
+	log.Printf("Worker %s deregistered\n", req.Address)
+	return
+}
+
+func (g *GolMasterRunner) Heartbeat(req stubs.WorkerRequest, res *stubs.WorkerResponse) (err error) {
+	res.Registered = registry.heartbeat(req.Address, req.Capacity)
+	return
+}
+
+// TickTime reports the latest completed turn of a session and its alive cell count, straight from
+// the state the turn loop published, so it answers at once whether or not the session is running.
+func (g *GolMasterRunner) TickTime(aliveRequest stubs.AliveRequest, aliveCellResponse *stubs.AliveResponse) (err error) {
+	session, err := getSession(aliveRequest.SessionID)
+	if err != nil {
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	aliveCellResponse.AliveCellCount = session.aliveCount
+	aliveCellResponse.CurrentTurns = session.turn
+	aliveCellResponse.Turns = session.turns
+	aliveCellResponse.Paused = session.paused
+	aliveCellResponse.Finished = session.finished()
+	return
+}
+
+// calculateNextState lets the broker compute turns itself when every worker has failed.
+func calculateNextState(world *util.BitGrid, rule util.Rule, topology util.Topology) *util.BitGrid {
+	nextWorld := util.NewBitGrid(world.Width, world.Height)
+	topology.NextRows(rule, nextWorld, world, 0, world.Height)
+	return nextWorld
 }
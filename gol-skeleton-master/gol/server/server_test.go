@@ -0,0 +1,1117 @@
+//go:build !worker
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/gol/server/strips"
+	"uk.ac.bris.cs/gameoflife/gol/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TestPartition checks that strips follow the weights while every strip keeps at least one row.
+func TestPartition(t *testing.T) {
+	tests := []struct {
+		height  int
+		weights []int
+		bounds  []int
+	}{
+		{10, []int{0, 1, 2, 3}, []int{0, 3, 6, 10}},
+		{12, []int{0, 1, 3, 4}, []int{0, 3, 9, 12}},
+		{4, []int{0, 1, 101}, []int{0, 1, 4}},
+		{3, []int{0, 100, 101, 102}, []int{0, 1, 2, 3}},
+		{5, []int{0, 1}, []int{0, 5}},
+	}
+	for _, test := range tests {
+		if bounds := partition(test.height, test.weights); !reflect.DeepEqual(bounds, test.bounds) {
+			t.Errorf("partition(%d, %v) = %v, expected %v", test.height, test.weights, bounds, test.bounds)
+		}
+	}
+}
+
+// TestLoadWorkerNodes checks that the -workers flag wins over GOL_WORKERS, which wins over
+// the -config file, and that blank lines and comments in the file are skipped.
+func TestLoadWorkerNodes(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "workers.txt")
+	if err := os.WriteFile(config, []byte("# workers\nhost-a:8040\n\n  host-b:8041  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		flag     string
+		env      string
+		config   string
+		expected []string
+	}{
+		{"a:1, b:2,,", "c:3", config, []string{"a:1", "b:2"}},
+		{"", "c:3,d:4", config, []string{"c:3", "d:4"}},
+		{"", "", config, []string{"host-a:8040", "host-b:8041"}},
+		{"", "", "", nil},
+	}
+	for _, test := range tests {
+		t.Setenv("GOL_WORKERS", test.env)
+		nodes, err := loadWorkerNodes(test.flag, test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(nodes, test.expected) {
+			t.Errorf("loadWorkerNodes(%q, %q) with GOL_WORKERS=%q = %v, expected %v", test.flag, test.config, test.env, nodes, test.expected)
+		}
+	}
+	if _, err := loadWorkerNodes("", filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Errorf("a missing config file was not reported")
+	}
+}
+
+// TestNoWorkers checks that a run is refused with an error naming the problem when the broker
+// has no workers, or none of its workers can be reached.
+func TestNoWorkers(t *testing.T) {
+	defer func(old *workerRegistry) { registry = old }(registry)
+	request := stubs.InitialRequest{NextWorld: util.NewBitGrid(8, 8), Turns: 1}
+
+	registry = newWorkerRegistry()
+	err := new(GolMasterRunner).MasterStart(request, new(stubs.StartResponse))
+	if err == nil || !strings.Contains(err.Error(), "no workers") {
+		t.Errorf("starting without workers returned %v", err)
+	}
+
+	// Nothing listens on a port that was just closed.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workerAddr := listener.Addr().String()
+	listener.Close()
+	registry.addStatic(workerAddr)
+	err = new(GolMasterRunner).MasterStart(request, new(stubs.StartResponse))
+	if err == nil || !strings.Contains(err.Error(), workerAddr) {
+		t.Errorf("starting with only an unreachable worker returned %v", err)
+	}
+}
+
+// TestWorkerRegistration registers workers over RPC instead of listing them on the command
+// line, and checks that a run is spread across them, that a worker which stops sending
+// heartbeats is expired, and that a deregistered worker is told to register again.
+func TestWorkerRegistration(t *testing.T) {
+	brokerAddr := startTestCluster(t, 2)
+	workerNodes, _ := registry.healthy()
+	registry = newWorkerRegistry()
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, workerAddr := range workerNodes {
+		res := new(stubs.WorkerResponse)
+		if err := client.Call(stubs.RegisterWorker, stubs.WorkerRequest{Address: workerAddr, Capacity: 2}, res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Registered {
+			t.Fatalf("worker %s was not registered", workerAddr)
+		}
+	}
+	if healthy, _ := registry.healthy(); !reflect.DeepEqual(healthy, workerNodes) {
+		t.Fatalf("the healthy workers are %v, expected %v", healthy, workerNodes)
+	}
+
+	world := randomWorld(32, 20, 3)
+	expected := world
+	for turn := 0; turn < 10; turn++ {
+		expected = calculateNextState(expected, util.Life, util.Torus)
+	}
+	start := new(stubs.StartResponse)
+	if err := client.Call(stubs.StartMaster, stubs.InitialRequest{NextWorld: world, Turns: 10}, start); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(stubs.Detach, stubs.ControlRequest{SessionID: start.SessionID}, new(stubs.ControlResponse)); err != nil {
+		t.Fatal(err)
+	}
+	final := new(stubs.FinalResponse)
+	if err := client.Call(stubs.Wait, stubs.ControlRequest{SessionID: start.SessionID}, final); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(final.FinalWorld.Words, expected.Words) || len(final.FailedWorkers) != 0 {
+		t.Fatalf("the run on the registered workers finished with a different world, failed workers: %v", final.FailedWorkers)
+	}
+
+	// The first worker falls silent while the second keeps up its heartbeats.
+	registry.workers[workerNodes[0]].lastSeen = time.Now().Add(-stubs.HeartbeatTimeout)
+	if healthy, _ := registry.healthy(); !reflect.DeepEqual(healthy, workerNodes[1:]) {
+		t.Fatalf("the healthy workers are %v after a missed heartbeat, expected %v", healthy, workerNodes[1:])
+	}
+	res := new(stubs.WorkerResponse)
+	if err := client.Call(stubs.Heartbeat, stubs.WorkerRequest{Address: workerNodes[1], Capacity: 2}, res); err != nil || !res.Registered {
+		t.Fatalf("the heartbeat of a registered worker returned %v, registered %v", err, res.Registered)
+	}
+	registry.expireStale()
+	if _, ok := registry.workers[workerNodes[0]]; ok {
+		t.Fatalf("worker %s was not expired", workerNodes[0])
+	}
+
+	if err := client.Call(stubs.DeregisterWorker, stubs.WorkerRequest{Address: workerNodes[1]}, new(stubs.WorkerResponse)); err != nil {
+		t.Fatal(err)
+	}
+	res = new(stubs.WorkerResponse)
+	if err := client.Call(stubs.Heartbeat, stubs.WorkerRequest{Address: workerNodes[1], Capacity: 2}, res); err != nil || res.Registered {
+		t.Fatalf("the heartbeat of a deregistered worker returned %v, registered %v", err, res.Registered)
+	}
+}
+
+// TestWeightedStrips registers two workers declaring different capacities, and checks each
+// is given a share of the rows in proportion to its capacity, and that a world whose height
+// does not split evenly between them still comes out right.
+func TestWeightedStrips(t *testing.T) {
+	brokerAddr := startTestCluster(t, 2)
+	workerNodes, _ := registry.healthy()
+	registry = newWorkerRegistry()
+	registry.register(workerNodes[0], 1)
+	registry.register(workerNodes[1], 3)
+
+	set := newStripSet(nextID(), util.NewBitGrid(16, 40), 1, util.Life, util.Torus, workerNodes)
+	rows := make(map[string]int)
+	for j, workerAddr := range set.owners {
+		rows[workerAddr] = set.bounds[j+1] - set.bounds[j]
+	}
+	set.release()
+	if rows[workerNodes[0]] != 10 || rows[workerNodes[1]] != 30 {
+		t.Fatalf("workers of capacity 1 and 3 were given %d and %d of 40 rows", rows[workerNodes[0]], rows[workerNodes[1]])
+	}
+
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	world := randomWorld(33, 23, 13)
+	expected := world
+	for turn := 0; turn < 30; turn++ {
+		expected = calculateNextState(expected, util.Life, util.Torus)
+	}
+	start := new(stubs.StartResponse)
+	if err := client.Call(stubs.StartMaster, stubs.InitialRequest{NextWorld: world, Turns: 30}, start); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(stubs.Detach, stubs.ControlRequest{SessionID: start.SessionID}, new(stubs.ControlResponse)); err != nil {
+		t.Fatal(err)
+	}
+	final := new(stubs.FinalResponse)
+	if err := client.Call(stubs.Wait, stubs.ControlRequest{SessionID: start.SessionID}, final); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(final.FinalWorld.Words, expected.Words) {
+		t.Fatalf("the run on weighted strips finished with a different world")
+	}
+}
+
+// TestSessionEvents checks that the event queue hands events to the controller in order,
+// drops them once acknowledged, merges turns when frames may be skipped and ignores events
+// while nobody is attached.
+func TestSessionEvents(t *testing.T) {
+	session, err := newSession(stubs.InitialRequest{NextWorld: util.NewBitGrid(8, 8), Turns: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := new(GolMasterRunner)
+	poll := func(after int) stubs.PollResponse {
+		var res stubs.PollResponse
+		if err := broker.PollEvents(stubs.PollRequest{SessionID: session.ID, After: after}, &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	session.emitTurn(1, []util.Cell{{X: 1, Y: 2}})
+	session.emit(stubs.SessionEvent{Kind: stubs.AliveCellsCountEvent, Turn: 1, AliveCount: 1})
+	res := poll(0)
+	if len(res.Events) != 3 || res.Last != 3 {
+		t.Fatalf("polled %d events up to %d, expected 3 up to 3", len(res.Events), res.Last)
+	}
+	kinds := []stubs.EventKind{stubs.CellsFlippedEvent, stubs.TurnCompleteEvent, stubs.AliveCellsCountEvent}
+	for i, event := range res.Events {
+		if event.Kind != kinds[i] || event.Turn != 1 {
+			t.Fatalf("event %d is %v at turn %d, expected %v at turn 1", i, event.Kind, event.Turn, kinds[i])
+		}
+	}
+
+	// Acknowledging part of the batch leaves the rest to be sent again.
+	session.emitTurn(2, nil)
+	res = poll(2)
+	if len(res.Events) != 3 || res.Events[0].Kind != stubs.AliveCellsCountEvent || res.Last != 5 {
+		t.Fatalf("polled %d events up to %d after acknowledging 2, expected 3 up to 5", len(res.Events), res.Last)
+	}
+	res = poll(5)
+	if len(res.Events) != 0 || res.Last != 5 {
+		t.Fatalf("polled %d events up to %d with nothing queued", len(res.Events), res.Last)
+	}
+
+	// With frames skipped, a controller that has fallen behind gets the turns merged.
+	session.skipFrames = true
+	turn := 2
+	for len(session.events) < maxQueuedEvents {
+		turn++
+		session.emitTurn(turn, nil)
+	}
+	session.emitTurn(turn+1, []util.Cell{{X: 3, Y: 3}, {X: 4, Y: 4}})
+	session.emitTurn(turn+2, []util.Cell{{X: 3, Y: 3}})
+	if len(session.events) != maxQueuedEvents {
+		t.Fatalf("%d events are queued, expected the turns to be merged into %d", len(session.events), maxQueuedEvents)
+	}
+	merged := session.events[len(session.events)-2]
+	if merged.Turn != turn+2 || !reflect.DeepEqual(merged.Cells, []util.Cell{{X: 4, Y: 4}}) {
+		t.Fatalf("the merged turn is %d with cells %v, expected %d with (4, 4)", merged.Turn, merged.Cells, turn+2)
+	}
+
+	// Detaching empties the queue, and nothing is queued until a controller attaches again.
+	session.setAttached(false)
+	session.emitTurn(turn+3, nil)
+	if len(session.events) != 0 {
+		t.Fatalf("%d events are queued without a controller", len(session.events))
+	}
+
+	close(session.done)
+	if res := poll(0); !res.Finished {
+		t.Fatalf("the poll did not report the session as finished")
+	}
+}
+
+// TestPollEvents starts a run and follows it through PollEvents alone. It checks events that
+// were not acknowledged are sent again, and that every turn arrives once, in order, as its
+// flipped cells followed by its TurnComplete.
+func TestPollEvents(t *testing.T) {
+	brokerAddr := startTestCluster(t, 2)
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	start := new(stubs.StartResponse)
+	if err := client.Call(stubs.StartMaster, stubs.InitialRequest{NextWorld: randomWorld(40, 30, 9), Turns: 200}, start); err != nil {
+		t.Fatal(err)
+	}
+	first := pollEvents(t, client, start.SessionID, 0)
+	again := pollEvents(t, client, start.SessionID, 0)
+	if len(first.Events) == 0 || len(again.Events) < len(first.Events) || !reflect.DeepEqual(again.Events[:len(first.Events)], first.Events) {
+		t.Fatalf("polling without acknowledging sent %d events, then %d that did not start with them", len(first.Events), len(again.Events))
+	}
+
+	turn := 0
+	flipped := false
+	for res := again; !res.Finished; res = pollEvents(t, client, start.SessionID, res.Last) {
+		for _, event := range res.Events {
+			switch event.Kind {
+			case stubs.CellsFlippedEvent:
+				if flipped || event.Turn != turn+1 {
+					t.Fatalf("cells flipped at turn %d arrived after turn %d", event.Turn, turn)
+				}
+				flipped = true
+			case stubs.TurnCompleteEvent:
+				if !flipped || event.Turn != turn+1 {
+					t.Fatalf("turn %d completed after turn %d, flipped cells sent %v", event.Turn, turn, flipped)
+				}
+				turn, flipped = event.Turn, false
+			}
+		}
+	}
+	if turn != 200 {
+		t.Fatalf("the events stopped at turn %d of 200", turn)
+	}
+}
+
+// TestFlippedCells follows a run by flipping the cells each CellsFlipped event names, and checks
+// it ends on the final world of the run. With frames skipped, a controller that falls behind is
+// sent merged turns, which must still add up to the same world.
+func TestFlippedCells(t *testing.T) {
+	brokerAddr := startTestCluster(t, 3)
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, skipFrames := range []bool{false, true} {
+		world := randomWorld(50, 30, 11)
+		request := stubs.InitialRequest{NextWorld: world, Turns: 1000, SkipFrames: skipFrames, Topology: util.CrossSurface}
+		start := new(stubs.StartResponse)
+		if err := client.Call(stubs.StartMaster, request, start); err != nil {
+			t.Fatal(err)
+		}
+		view := util.NewBitGrid(world.Width, world.Height)
+		copy(view.Words, world.Words)
+		merged := false
+		for res := pollEvents(t, client, start.SessionID, 0); !res.Finished; res = pollEvents(t, client, start.SessionID, res.Last) {
+			turn := 0
+			for _, event := range res.Events {
+				if event.Kind == stubs.TurnCompleteEvent {
+					merged = merged || (turn != 0 && event.Turn > turn+1)
+					turn = event.Turn
+				}
+				if event.Kind == stubs.CellsFlippedEvent {
+					for _, cell := range event.Cells {
+						view.Set(cell.X, cell.Y, !view.Get(cell.X, cell.Y))
+					}
+				}
+			}
+			// Fall behind the run for a while.
+			if skipFrames && !merged {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		if skipFrames && !merged {
+			t.Errorf("no turns were merged for a controller that fell behind")
+		}
+
+		final := new(stubs.FinalResponse)
+		if err := client.Call(stubs.Wait, stubs.ControlRequest{SessionID: start.SessionID}, final); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(view.Words, final.FinalWorld.Words) {
+			t.Errorf("flipping the cells sent with frames skipped %v does not give the final world", skipFrames)
+		}
+	}
+}
+
+// TestBrokerWorkers runs sessions on a broker and three workers in this process, talking over
+// loopback connections, and checks the result against the broker stepping the world alone.
+func TestBrokerWorkers(t *testing.T) {
+	brokerAddr := startTestCluster(t, 3)
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	world := randomWorld(70, 23, 1)
+	for _, topology := range []util.Topology{util.Torus, util.Plane, util.KleinBottle, util.CrossSurface} {
+		t.Run(topology.String(), func(t *testing.T) {
+			expected := world
+			for turn := 0; turn < 50; turn++ {
+				expected = calculateNextState(expected, util.Life, topology)
+			}
+
+			request := stubs.InitialRequest{NextWorld: world, Turns: 50, Topology: topology}
+			start := new(stubs.StartResponse)
+			if err := client.Call(stubs.StartMaster, request, start); err != nil {
+				t.Fatal(err)
+			}
+			// Nobody polls for events, so let the session run without a controller.
+			if err := client.Call(stubs.Detach, stubs.ControlRequest{SessionID: start.SessionID}, new(stubs.ControlResponse)); err != nil {
+				t.Fatal(err)
+			}
+			final := new(stubs.FinalResponse)
+			if err := client.Call(stubs.Wait, stubs.ControlRequest{SessionID: start.SessionID}, final); err != nil {
+				t.Fatal(err)
+			}
+			if final.TurnsCompleted != 50 || !reflect.DeepEqual(final.FinalWorld.Words, expected.Words) {
+				t.Fatalf("the session finished at turn %d with a different world", final.TurnsCompleted)
+			}
+		})
+	}
+}
+
+// TestWorkerFailure stops one of three workers answering partway through a run, either by
+// leaving its connections open with nothing coming back or by killing it outright. It checks
+// the run rolls back and finishes on the other workers, reporting the failed worker.
+func TestWorkerFailure(t *testing.T) {
+	defer func(timeout time.Duration, interval int) {
+		workerTimeout, checkpointInterval = timeout, interval
+	}(workerTimeout, checkpointInterval)
+	workerTimeout, checkpointInterval = 200*time.Millisecond, 25
+
+	world := randomWorld(40, 30, 4)
+	expected := world
+	for turn := 0; turn < 300; turn++ {
+		expected = calculateNextState(expected, util.Life, util.Torus)
+	}
+	for _, kill := range []bool{false, true} {
+		name := "stalled"
+		if kill {
+			name = "killed"
+		}
+		t.Run(name, func(t *testing.T) {
+			brokerAddr := startTestCluster(t, 3)
+			workerNodes, _ := registry.healthy()
+			proxy := startProxy(t, workerNodes[0])
+			registry.deregister(workerNodes[0])
+			registry.addStatic(proxy.addr)
+			client, err := stubs.Dial(brokerAddr, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			start := new(stubs.StartResponse)
+			if err := client.Call(stubs.StartMaster, stubs.InitialRequest{NextWorld: world, Turns: 300}, start); err != nil {
+				t.Fatal(err)
+			}
+			last := 0
+			for turn := 0; turn < 40; {
+				res := pollEvents(t, client, start.SessionID, last)
+				last = res.Last
+				for _, event := range res.Events {
+					if event.Kind == stubs.TurnCompleteEvent {
+						turn = event.Turn
+					}
+				}
+			}
+
+			if kill {
+				proxy.kill()
+			} else {
+				proxy.stall()
+			}
+			var failed []string
+			for finished := false; !finished; {
+				res := pollEvents(t, client, start.SessionID, last)
+				last, finished = res.Last, res.Finished
+				for _, event := range res.Events {
+					if event.Kind == stubs.WorkerFailedEvent {
+						failed = append(failed, event.Worker)
+					}
+				}
+			}
+			if !reflect.DeepEqual(failed, []string{proxy.addr}) {
+				t.Fatalf("the failed workers reported are %v, expected %s", failed, proxy.addr)
+			}
+			final := new(stubs.FinalResponse)
+			if err := client.Call(stubs.Wait, stubs.ControlRequest{SessionID: start.SessionID}, final); err != nil {
+				t.Fatal(err)
+			}
+			if final.TurnsCompleted != 300 || !reflect.DeepEqual(final.FinalWorld.Words, expected.Words) {
+				t.Fatalf("the session finished at turn %d with a different world", final.TurnsCompleted)
+			}
+			if !reflect.DeepEqual(final.FailedWorkers, []string{proxy.addr}) {
+				t.Fatalf("the result lists %v as failed, expected %s", final.FailedWorkers, proxy.addr)
+			}
+		})
+	}
+}
+
+// TestResend breaks the connection to a worker after it has handled a call but before the
+// reply arrives. It checks that loading a strip is sent again, while stepping a strip is not,
+// since that would step the strip twice.
+func TestResend(t *testing.T) {
+	startTestCluster(t, 1)
+	workerNodes, _ := registry.healthy()
+	proxy := startProxy(t, workerNodes[0])
+
+	world := randomWorld(70, 8, 5)
+	id := stubs.StripID{Run: nextID()}
+	load := stubs.StripRequest{ID: id, StartY: 0, EndY: world.Height, Width: world.Width, Rows: world}
+	if err := callWorker(proxy.addr, stubs.LoadStrip, load, new(stubs.StripResponse)); err != nil {
+		t.Fatal(err)
+	}
+	proxy.cut()
+	if err := callWorker(proxy.addr, stubs.LoadStrip, load, new(stubs.StripResponse)); err != nil {
+		t.Fatalf("loading a strip was not sent again after the connection broke: %v", err)
+	}
+
+	proxy.cut()
+	step := stubs.HaloRequest{ID: id, Top: world.Row(world.Height - 1), Bottom: world.Row(0)}
+	if err := callWorker(proxy.addr, stubs.StepStrip, step, new(stubs.HaloResponse)); err == nil {
+		t.Fatalf("stepping a strip succeeded although its reply was lost")
+	}
+	res := new(stubs.StripResponse)
+	if err := callWorker(proxy.addr, stubs.CollectStrip, stubs.StripRequest{ID: id}, res); err != nil {
+		t.Fatal(err)
+	}
+	if expected := calculateNextState(world, util.Life, util.Torus); !reflect.DeepEqual(res.Rows.Words, expected.Words) {
+		t.Fatalf("the strip was not stepped exactly once")
+	}
+}
+
+// TestControls drives a session the way the controller's keypresses do, pausing and resuming
+// it, taking snapshots, detaching and finally shutting the broker down.
+func TestControls(t *testing.T) {
+	exited := make(chan int, 1)
+	defer func(old func(int)) { exit = old }(exit)
+	exit = func(code int) { exited <- code }
+
+	brokerAddr := startTestCluster(t, 2)
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	world := randomWorld(40, 30, 6)
+	start := new(stubs.StartResponse)
+	if err := client.Call(stubs.StartMaster, stubs.InitialRequest{NextWorld: world, Turns: 1 << 30}, start); err != nil {
+		t.Fatal(err)
+	}
+	control := func(method string) stubs.ControlResponse {
+		var res stubs.ControlResponse
+		if err := client.Call(method, stubs.ControlRequest{SessionID: start.SessionID}, &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	// expect polls until an event of the given kind arrives.
+	last := 0
+	expect := func(kind stubs.EventKind) stubs.SessionEvent {
+		for {
+			res := pollEvents(t, client, start.SessionID, last)
+			if res.Finished {
+				t.Fatalf("the session finished while waiting for %v", kind)
+			}
+			for i, event := range res.Events {
+				if event.Kind == kind {
+					last = res.Last - len(res.Events) + i + 1
+					return event
+				}
+			}
+			last = res.Last
+		}
+	}
+	// snapshot checks the world handed back by Snapshot against the world stepped on its own.
+	snapshot := func() int {
+		res := control(stubs.Snapshot)
+		expected := world
+		for turn := 0; turn < res.Turn; turn++ {
+			expected = calculateNextState(expected, util.Life, util.Torus)
+		}
+		if !reflect.DeepEqual(res.World.Words, expected.Words) {
+			t.Fatalf("the snapshot at turn %d differs from the world stepped on its own", res.Turn)
+		}
+		return res.Turn
+	}
+
+	expect(stubs.TurnCompleteEvent)
+	paused := control(stubs.Pause)
+	if event := expect(stubs.StateChangeEvent); !event.Paused || event.Turn != paused.Turn {
+		t.Fatalf("pausing at turn %d reported paused %v at turn %d", paused.Turn, event.Paused, event.Turn)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if turn := snapshot(); turn != paused.Turn {
+		t.Fatalf("the session moved from turn %d to %d while paused", paused.Turn, turn)
+	}
+	control(stubs.Resume)
+	if event := expect(stubs.StateChangeEvent); event.Paused {
+		t.Fatalf("resuming reported the session as paused")
+	}
+	if event := expect(stubs.TurnCompleteEvent); event.Turn <= paused.Turn {
+		t.Fatalf("turn %d completed after resuming at turn %d", event.Turn, paused.Turn)
+	}
+
+	// Once detached, the session carries on without anyone polling.
+	detached := control(stubs.Detach)
+	session, err := getSession(start.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.watched() {
+		t.Fatalf("the session is still watched after detaching")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if turn := snapshot(); turn <= detached.Turn {
+		t.Fatalf("the session stayed at turn %d after detaching at turn %d", turn, detached.Turn)
+	}
+
+	stopped := control(stubs.Shutdown)
+	if !session.finished() || session.result.TurnsCompleted != stopped.Turn {
+		t.Fatalf("the session was not stopped at turn %d by the shutdown", stopped.Turn)
+	}
+	select {
+	case code := <-exited:
+		if code != 0 {
+			t.Fatalf("the broker exited with code %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the broker did not exit after shutting down")
+	}
+}
+
+// TestReattach detaches the controller from a session and attaches a new one while the session
+// carries on. It checks the new controller is handed the world, rule and topology of the session,
+// and that its events carry on from the turn it was handed.
+func TestReattach(t *testing.T) {
+	brokerAddr := startTestCluster(t, 2)
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	world := randomWorld(48, 20, 7)
+	rule, err := util.ParseRule("B36/S23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := stubs.InitialRequest{NextWorld: world, Turns: 1 << 30, Rule: rule, Topology: util.Plane}
+	start := new(stubs.StartResponse)
+	if err := client.Call(stubs.StartMaster, request, start); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if session, err := getSession(start.SessionID); err == nil {
+			session.control(stopAction)
+		}
+	}()
+	pollEvents(t, client, start.SessionID, 0)
+	detached := new(stubs.ControlResponse)
+	if err := client.Call(stubs.Detach, stubs.ControlRequest{SessionID: start.SessionID}, detached); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The new controller attaches to the most recent session without naming it.
+	other, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	attached := new(stubs.ControlResponse)
+	if err := other.Call(stubs.Attach, stubs.ControlRequest{}, attached); err != nil {
+		t.Fatal(err)
+	}
+	if attached.SessionID != start.SessionID || attached.Turns != request.Turns || attached.Rule != rule || attached.Topology != util.Plane {
+		t.Fatalf("attached to session %s running %d turns of %v on a %v", attached.SessionID, attached.Turns, attached.Rule, attached.Topology)
+	}
+	if attached.Turn <= detached.Turn {
+		t.Fatalf("the session stayed at turn %d after detaching at turn %d", attached.Turn, detached.Turn)
+	}
+	expected := world
+	for turn := 0; turn < attached.Turn; turn++ {
+		expected = calculateNextState(expected, rule, util.Plane)
+	}
+	if !reflect.DeepEqual(attached.World.Words, expected.Words) {
+		t.Fatalf("the world handed over at turn %d differs from the world stepped on its own", attached.Turn)
+	}
+
+	res := pollEvents(t, other, attached.SessionID, 0)
+	turn := attached.Turn
+	for _, event := range res.Events {
+		if event.Kind == stubs.TurnCompleteEvent {
+			if event.Turn != turn+1 {
+				t.Fatalf("turn %d completed after turn %d", event.Turn, turn)
+			}
+			turn = event.Turn
+		}
+	}
+	if turn == attached.Turn {
+		t.Fatalf("no turns completed after attaching at turn %d", attached.Turn)
+	}
+}
+
+// TestTickTime checks that TickTime answers at once from the latest completed turn, whether the
+// session is paused, running or finished, and fails rather than waiting for an unknown session.
+func TestTickTime(t *testing.T) {
+	brokerAddr := startTestCluster(t, 2)
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tick := func(sessionID string) (stubs.AliveResponse, error) {
+		var res stubs.AliveResponse
+		err := client.Call(stubs.RunTicker, stubs.AliveRequest{SessionID: sessionID}, &res)
+		return res, err
+	}
+	if _, err := tick("unknown"); err == nil {
+		t.Fatalf("TickTime answered for a session that was never started")
+	}
+
+	world := randomWorld(40, 30, 8)
+	start := new(stubs.StartResponse)
+	if err := client.Call(stubs.StartMaster, stubs.InitialRequest{NextWorld: world, Turns: 1 << 30}, start); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(stubs.Detach, stubs.ControlRequest{SessionID: start.SessionID}, new(stubs.ControlResponse)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	session, err := getSession(start.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paused, err := session.control(pauseAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tick(start.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := world
+	for turn := 0; turn < paused.Turn; turn++ {
+		expected = calculateNextState(expected, util.Life, util.Torus)
+	}
+	if !res.Paused || res.CurrentTurns != paused.Turn || res.Turns != 1<<30 || res.AliveCellCount != expected.PopCount() {
+		t.Fatalf("TickTime reported %d alive cells at turn %d of %d, paused %v, expected %d at turn %d of %d, paused",
+			res.AliveCellCount, res.CurrentTurns, res.Turns, res.Paused, expected.PopCount(), paused.Turn, 1<<30)
+	}
+
+	if _, err := session.control(resumeAction); err != nil {
+		t.Fatal(err)
+	}
+	stopped, err := session.control(stopAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := tick(start.SessionID); err != nil || !res.Finished || res.Paused || res.CurrentTurns != stopped.Turn {
+		t.Fatalf("TickTime reported turn %d, finished %v and paused %v after stopping at turn %d: %v",
+			res.CurrentTurns, res.Finished, res.Paused, stopped.Turn, err)
+	}
+}
+
+// TestConcurrentSessions runs sessions with different sizes, turns, rules and topologies on the
+// same workers at once, and checks each finishes with its own world.
+func TestConcurrentSessions(t *testing.T) {
+	brokerAddr := startTestCluster(t, 3)
+	sessionRules := []string{"B3/S23", "B36/S23", "B3678/S34678"}
+	var wg sync.WaitGroup
+	for i, topology := range []util.Topology{util.Torus, util.Plane, util.KleinBottle} {
+		rule, err := util.ParseRule(sessionRules[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		world := randomWorld(30+20*i, 40-10*i, int64(10+i))
+		turns := 40 + 30*i
+		wg.Add(1)
+		go func(world *util.BitGrid, turns int, rule util.Rule, topology util.Topology) {
+			defer wg.Done()
+			client, err := stubs.Dial(brokerAddr, time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer client.Close()
+
+			request := stubs.InitialRequest{NextWorld: world, Turns: turns, Rule: rule, Topology: topology}
+			start := new(stubs.StartResponse)
+			if err := client.Call(stubs.StartMaster, request, start); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := client.Call(stubs.Detach, stubs.ControlRequest{SessionID: start.SessionID}, new(stubs.ControlResponse)); err != nil {
+				t.Error(err)
+				return
+			}
+			final := new(stubs.FinalResponse)
+			if err := client.Call(stubs.Wait, stubs.ControlRequest{SessionID: start.SessionID}, final); err != nil {
+				t.Error(err)
+				return
+			}
+			expected := world
+			for turn := 0; turn < turns; turn++ {
+				expected = calculateNextState(expected, rule, topology)
+			}
+			if final.TurnsCompleted != turns || !reflect.DeepEqual(final.FinalWorld.Words, expected.Words) {
+				t.Errorf("the %v session on a %v finished at turn %d with a different world", rule, topology, final.TurnsCompleted)
+			}
+		}(world, turns, rule, topology)
+	}
+	wg.Wait()
+}
+
+// TestSharedWorkers checks that sessions too small to use every worker are placed on the ones
+// holding the fewest strips.
+func TestSharedWorkers(t *testing.T) {
+	startTestCluster(t, 3)
+	workerNodes, _ := registry.healthy()
+	var sets []*stripSet
+	owners := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		set := newStripSet(nextID(), util.NewBitGrid(8, 1), 1, util.Life, util.Torus, workerNodes)
+		sets = append(sets, set)
+		owners[set.owners[0]] = true
+	}
+	for _, set := range sets {
+		set.release()
+	}
+	if len(owners) != len(workerNodes) {
+		t.Fatalf("three single strip sessions were placed on %d of three workers", len(owners))
+	}
+}
+
+// TestNonSquare runs worlds much wider than they are tall, and the other way round, across
+// three workers, and checks the result against the broker stepping the world alone.
+func TestNonSquare(t *testing.T) {
+	brokerAddr := startTestCluster(t, 3)
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, size := range []util.Cell{{X: 128, Y: 64}, {X: 512, Y: 16}, {X: 16, Y: 512}, {X: 100, Y: 2}} {
+		t.Run(fmt.Sprintf("%dx%d", size.X, size.Y), func(t *testing.T) {
+			world := randomWorld(size.X, size.Y, 12)
+			expected := world
+			for turn := 0; turn < 20; turn++ {
+				expected = calculateNextState(expected, util.Life, util.Torus)
+			}
+
+			request := stubs.InitialRequest{NextWorld: world, Width: size.X, Height: size.Y, Turns: 20}
+			start := new(stubs.StartResponse)
+			if err := client.Call(stubs.StartMaster, request, start); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Call(stubs.Detach, stubs.ControlRequest{SessionID: start.SessionID}, new(stubs.ControlResponse)); err != nil {
+				t.Fatal(err)
+			}
+			final := new(stubs.FinalResponse)
+			if err := client.Call(stubs.Wait, stubs.ControlRequest{SessionID: start.SessionID}, final); err != nil {
+				t.Fatal(err)
+			}
+			if final.FinalWorld.Width != size.X || final.FinalWorld.Height != size.Y || !reflect.DeepEqual(final.FinalWorld.Words, expected.Words) {
+				t.Fatalf("the session finished with a different %dx%d world", final.FinalWorld.Width, final.FinalWorld.Height)
+			}
+			if !reflect.DeepEqual(final.AliveCells, expected.AliveCells(0)) {
+				t.Fatalf("the session reported %d alive cells, expected %d", len(final.AliveCells), expected.PopCount())
+			}
+		})
+	}
+
+	// A world that does not match the size in the request is refused.
+	request := stubs.InitialRequest{NextWorld: randomWorld(64, 128, 12), Width: 128, Height: 64, Turns: 20}
+	if err := client.Call(stubs.StartMaster, request, new(stubs.StartResponse)); err == nil {
+		t.Fatalf("a 64x128 world was started as 128x64")
+	}
+}
+
+// TestLocalEngine runs the same image with the controller's local engine and on the broker, and
+// checks both send the controller the same events. Alive cell counts are left out, since they
+// are sent on a timer rather than on a turn.
+func TestLocalEngine(t *testing.T) {
+	brokerAddr := startTestCluster(t, 3)
+	run := func(broker string) []gol.Event {
+		p := gol.Params{Turns: 50, Threads: 4, ImageWidth: 64, ImageHeight: 64, Broker: broker, InputPath: "../../images/64x64.pgm", OutputDir: t.TempDir()}
+		events := make(chan gol.Event, 1000)
+		go gol.Run(p, events, nil)
+		var received []gol.Event
+		for event := range events {
+			switch e := event.(type) {
+			case gol.AliveCellsCount:
+				continue
+			case gol.CellsFlipped:
+				sort.Slice(e.Cells, func(i, j int) bool {
+					return e.Cells[i].Y < e.Cells[j].Y || e.Cells[i].Y == e.Cells[j].Y && e.Cells[i].X < e.Cells[j].X
+				})
+			}
+			received = append(received, event)
+		}
+		return received
+	}
+
+	local, remote := run(""), run(brokerAddr)
+	if len(local) != len(remote) {
+		t.Fatalf("the local engine sent %d events, the broker %d", len(local), len(remote))
+	}
+	for i := range local {
+		if !reflect.DeepEqual(local[i], remote[i]) {
+			t.Fatalf("event %d is %v locally and %v on the broker", i, local[i], remote[i])
+		}
+	}
+}
+
+// TestSessionLimit starts one session more than the broker allows, and checks that the last
+// start is refused while the sessions already running carry on.
+func TestSessionLimit(t *testing.T) {
+	defer func(limit int) { maxSessions = limit }(maxSessions)
+	maxSessions = 2
+	brokerAddr := startTestCluster(t, 2)
+	client, err := stubs.Dial(brokerAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	start := func() (string, error) {
+		request := stubs.InitialRequest{NextWorld: randomWorld(16, 16, 2), Turns: 1 << 30}
+		res := new(stubs.StartResponse)
+		if err := client.Call(stubs.StartMaster, request, res); err != nil {
+			return "", err
+		}
+		// Nobody polls for events, so let the session run without a controller.
+		return res.SessionID, client.Call(stubs.Detach, stubs.ControlRequest{SessionID: res.SessionID}, new(stubs.ControlResponse))
+	}
+	var ids []string
+	for i := 0; i < maxSessions; i++ {
+		id, err := start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if _, err := start(); err == nil {
+		t.Fatalf("a session was started beyond the limit of %d", maxSessions)
+	}
+	for _, id := range ids {
+		session, err := getSession(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.finished() {
+			t.Fatalf("session %s was stopped to make room for another", id)
+		}
+		if _, err := session.control(stopAction); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var registerOnce sync.Once
+
+// startTestCluster serves the broker and the worker RPCs on loopback listeners, one for the
+// broker and one per worker, and registers the workers as static workers of a fresh registry.
+// It returns the address of the broker.
+func startTestCluster(t *testing.T, workers int) string {
+	registerOnce.Do(func() {
+		if err := rpc.Register(new(GolMasterRunner)); err != nil {
+			t.Fatal(err)
+		}
+		if err := rpc.RegisterName("GameOfLifeOperations", strips.NewStore(2)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	registry = newWorkerRegistry()
+	t.Cleanup(pool.closeAll)
+
+	listen := func() string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go stubs.ServeConn(conn)
+			}
+		}()
+		return listener.Addr().String()
+	}
+	for i := 0; i < workers; i++ {
+		registry.addStatic(listen())
+	}
+	return listen()
+}
+
+// workerProxy passes connections through to a worker, until it is told to stop answering.
+type workerProxy struct {
+	addr     string
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+	stalled  bool
+	cutReply bool // drop the next reply from the worker and close its connection
+}
+
+// startProxy listens on a loopback port and passes every connection on to workerAddr.
+func startProxy(t *testing.T, workerAddr string) *workerProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &workerProxy{addr: listener.Addr().String(), listener: listener}
+	t.Cleanup(p.kill)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			worker, err := net.Dial("tcp", workerAddr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mutex.Lock()
+			p.conns = append(p.conns, conn, worker)
+			p.mutex.Unlock()
+			go p.pipe(worker, conn, false)
+			go p.pipe(conn, worker, true)
+		}
+	}()
+	return p
+}
+
+// pipe copies from src to dst, dropping everything once the proxy has stalled. Replies come
+// from the worker.
+func (p *workerProxy) pipe(dst net.Conn, src net.Conn, replies bool) {
+	defer dst.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		p.mutex.Lock()
+		stalled := p.stalled
+		cut := replies && n > 0 && p.cutReply
+		if cut {
+			p.cutReply = false
+		}
+		p.mutex.Unlock()
+		if cut {
+			src.Close()
+			return
+		}
+		if n > 0 && !stalled {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stall keeps the connections open but stops anything getting through them.
+func (p *workerProxy) stall() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stalled = true
+}
+
+// cut lets the worker handle the next call, but breaks the connection before its reply gets through.
+func (p *workerProxy) cut() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.cutReply = true
+}
+
+// kill closes the listener and every connection, as if the worker had died.
+func (p *workerProxy) kill() {
+	p.listener.Close()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// pollEvents makes one PollEvents call, acknowledging every event up to last.
+func pollEvents(t *testing.T, client *rpc.Client, sessionID string, last int) stubs.PollResponse {
+	var res stubs.PollResponse
+	if err := client.Call(stubs.PollEvents, stubs.PollRequest{SessionID: sessionID, After: last}, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func randomWorld(width, height int, seed int64) *util.BitGrid {
+	random := rand.New(rand.NewSource(seed))
+	world := util.NewBitGrid(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			world.Set(x, y, random.Intn(3) == 0)
+		}
+	}
+	return world
+}
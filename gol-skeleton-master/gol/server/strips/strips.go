@@ -0,0 +1,213 @@
+// Package strips holds the strips of the world a worker steps on behalf of the broker.
+package strips
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"uk.ac.bris.cs/gameoflife/gol/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// Store is the part of a worker's RPC service that owns its strips across turns.
+type Store struct {
+	mutex   sync.Mutex
+	strips  map[stubs.StripID]*strip
+	threads int // goroutines per strip when the broker doesn't ask for a number
+}
+
+// strip is a band of rows of the world owned by this worker across turns.
+type strip struct {
+	startY   int
+	width    int
+	rows     *util.BitGrid
+	rule     util.Rule
+	topology util.Topology
+}
+
+// NewStore makes a store with no strips, splitting each strip between threads goroutines
+// unless the broker asks for a number.
+func NewStore(threads int) *Store {
+	return &Store{strips: make(map[stubs.StripID]*strip), threads: threads}
+}
+
+// LoadStrip hands this worker ownership of a strip of rows, replacing any strip it held under the same ID.
+func (g *Store) LoadStrip(req stubs.StripRequest, res *stubs.StripResponse) (err error) {
+	if req.Rows == nil || req.Rows.Height == 0 {
+		err = errors.New("no strip received")
+		return
+	}
+	if req.Rows.Height != req.EndY-req.StartY {
+		err = fmt.Errorf("received %d rows for world rows %d to %d", req.Rows.Height, req.StartY, req.EndY)
+		return
+	}
+	if req.Rows.Width != req.Width || len(req.Rows.Words) != util.WordsPerRow(req.Width)*req.Rows.Height {
+		err = fmt.Errorf("the strip has rows of %d cells, expected %d", req.Rows.Width, req.Width)
+		return
+	}
+
+	rule := req.Rule
+	if rule == (util.Rule{}) {
+		rule = util.Life
+	}
+
+	g.mutex.Lock()
+	g.strips[req.ID] = &strip{startY: req.StartY, width: req.Width, rows: req.Rows, rule: rule, topology: req.Topology}
+	g.mutex.Unlock()
+
+	res.ID = req.ID
+	res.StartY = req.StartY
+	return
+}
+
+// StepStrip advances a strip by one turn using the halo rows sent by the broker, and returns
+// the strip's new edge rows so the broker can pass them on to the neighbouring strips.
+func (g *Store) StepStrip(req stubs.HaloRequest, res *stubs.HaloResponse) (err error) {
+	s, err := g.strip(req.ID)
+	if err != nil {
+		return
+	}
+
+	if words := util.WordsPerRow(s.width); len(req.Top) != words || len(req.Bottom) != words {
+		err = fmt.Errorf("halo rows have %d and %d words, expected %d", len(req.Top), len(req.Bottom), words)
+		return
+	}
+	twisted := s.topology.TwistsX()
+	if words := util.WordsPerRow(s.rows.Height + 2); twisted && (len(req.West) != words || len(req.East) != words) {
+		err = fmt.Errorf("halo columns have %d and %d words, expected %d", len(req.West), len(req.East), words)
+		return
+	}
+
+	threads := req.Threads
+	if threads < 1 {
+		threads = g.threads
+	}
+	nextRows := calculateNextState(s.rows, req.Top, req.Bottom, threads, s.rule, s.topology.WrapsX())
+	if twisted {
+		nextEdges(nextRows, s.rows, req.Top, req.Bottom, req.West, req.East, s.rule)
+	}
+	if req.Flipped {
+		res.Flipped = s.rows.FlippedCells(nextRows, s.startY)
+	}
+	s.rows = nextRows
+
+	res.Top = s.rows.Row(0)
+	res.Bottom = s.rows.Row(s.rows.Height - 1)
+	if twisted {
+		res.West = s.rows.Column(0)
+		res.East = s.rows.Column(s.width - 1)
+	}
+	res.AliveCount = s.rows.PopCount()
+	return
+}
+
+// CollectStrip sends the current rows of a strip back to the broker.
+func (g *Store) CollectStrip(req stubs.StripRequest, res *stubs.StripResponse) (err error) {
+	s, err := g.strip(req.ID)
+	if err != nil {
+		return
+	}
+
+	res.ID = req.ID
+	res.StartY = s.startY
+	res.Rows = s.rows
+	return
+}
+
+// DropStrip releases a strip once the broker has finished with it.
+func (g *Store) DropStrip(req stubs.StripRequest, res *stubs.StripResponse) (err error) {
+	g.mutex.Lock()
+	delete(g.strips, req.ID)
+	g.mutex.Unlock()
+
+	res.ID = req.ID
+	return
+}
+
+func (g *Store) strip(id stubs.StripID) (*strip, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	s, ok := g.strips[id]
+	if !ok {
+		return nil, fmt.Errorf("strip %v is not held by this worker", id)
+	}
+	return s, nil
+}
+
+// calculateNextState computes the next state of a strip under the rule, splitting its rows
+// between threads goroutines. The rows wrap around horizontally if wrap is set. top and bottom
+// are the halo rows directly above and below the strip, as sent by the broker, so only the
+// horizontal wrap around is left to work out here.
+func calculateNextState(rows *util.BitGrid, top []uint64, bottom []uint64, threads int, rule util.Rule, wrap bool) *util.BitGrid {
+	height := rows.Height
+	nextRows := util.NewBitGrid(rows.Width, height)
+
+	// row returns a row of the strip, falling back to the halo rows at its edges
+	row := func(y int) []uint64 {
+		if y < 0 {
+			return top
+		}
+		if y >= height {
+			return bottom
+		}
+		return rows.Row(y)
+	}
+
+	// Each goroutine computes its own band of rows of the strip
+	var wg sync.WaitGroup
+	if threads > height {
+		threads = height
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(startY, endY int) {
+			defer wg.Done()
+			for y := startY; y < endY; y++ {
+				rule.NextRow(nextRows.Row(y), row(y-1), row(y), row(y+1), rows.Width, wrap)
+			}
+		}(t*height/threads, (t+1)*height/threads)
+	}
+	wg.Wait()
+
+	// Return the next state of the strip
+	return nextRows
+}
+
+// nextEdges works out the cells on the west and east edges of the next state of a strip when
+// their neighbours beyond those edges are on other rows. west and east hold those neighbours,
+// from the row above the strip to the row below it.
+func nextEdges(nextRows *util.BitGrid, rows *util.BitGrid, top []uint64, bottom []uint64, west []uint64, east []uint64, rule util.Rule) {
+	// alive reports whether the cell at (x, y) of the strip is alive, where (x, y) may be one
+	// cell beyond any of its edges.
+	alive := func(x, y int) bool {
+		switch {
+		case x < 0:
+			return util.RowCell(west, y+1)
+		case x >= rows.Width:
+			return util.RowCell(east, y+1)
+		case y < 0:
+			return util.RowCell(top, x)
+		case y >= rows.Height:
+			return util.RowCell(bottom, x)
+		}
+		return rows.Get(x, y)
+	}
+
+	for y := 0; y < rows.Height; y++ {
+		for _, x := range []int{0, rows.Width - 1} {
+			neighbours := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if (dx != 0 || dy != 0) && alive(x+dx, y+dy) {
+						neighbours++
+					}
+				}
+			}
+			nextRows.Set(x, y, rule.Next(rows.Get(x, y), neighbours))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package strips
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/gol/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TestCalculateNextState steps a random world in strips, passing each strip the rows above and
+// below it as halos, and the cells beyond its west and east edges on a cross-surface. It checks
+// the strips join up into the turn stepped on the whole world.
+func TestCalculateNextState(t *testing.T) {
+	width, height := 70, 20
+	world := randomWorld(width, height, 1)
+	bounds := []int{0, 1, 6, 13, 20}
+	for _, topology := range []util.Topology{util.Torus, util.Plane, util.Cylinder, util.KleinBottle, util.CrossSurface} {
+		expected := util.NewBitGrid(width, height)
+		topology.NextRows(util.Life, expected, world, 0, height)
+		for _, threads := range []int{1, 3, 8} {
+			t.Run(fmt.Sprintf("%v-%d", topology, threads), func(t *testing.T) {
+				for j := 0; j+1 < len(bounds); j++ {
+					startY, endY := bounds[j], bounds[j+1]
+					top, bottom := halo(world, topology, startY-1), halo(world, topology, endY)
+					next := calculateNextState(world.Rows(startY, endY), top, bottom, threads, util.Life, topology.WrapsX())
+					if topology.TwistsX() {
+						west, east := beyondX(world, topology, startY, endY)
+						nextEdges(next, world.Rows(startY, endY), top, bottom, west, east, util.Life)
+					}
+					for y := startY; y < endY; y++ {
+						for x := 0; x < width; x++ {
+							if next.Get(x, y-startY) != expected.Get(x, y) {
+								t.Fatalf("(%d, %d) in rows %d to %d differs from the whole world", x, y, startY, endY)
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestStore loads a world into a store as three strips and steps them for several turns,
+// passing each strip only the edge rows its neighbours returned on the turn before. It checks
+// the rows collected at the end are the world stepped whole, and that dropped strips are gone.
+func TestStore(t *testing.T) {
+	width, height, turns := 70, 20, 10
+	world := randomWorld(width, height, 2)
+	expected := world
+	for turn := 0; turn < turns; turn++ {
+		next := util.NewBitGrid(width, height)
+		util.Torus.NextRows(util.Life, next, expected, 0, height)
+		expected = next
+	}
+
+	store := NewStore(2)
+	bounds := []int{0, 7, 8, 20}
+	count := len(bounds) - 1
+	tops := make([][]uint64, count)
+	bottoms := make([][]uint64, count)
+	for j := 0; j < count; j++ {
+		req := stubs.StripRequest{ID: stubs.StripID{Run: 1, Index: j}, StartY: bounds[j], EndY: bounds[j+1], Width: width, Rows: world.Rows(bounds[j], bounds[j+1])}
+		if err := store.LoadStrip(req, new(stubs.StripResponse)); err != nil {
+			t.Fatal(err)
+		}
+		tops[j], bottoms[j] = world.Row(bounds[j]), world.Row(bounds[j+1]-1)
+	}
+
+	for turn := 0; turn < turns; turn++ {
+		responses := make([]stubs.HaloResponse, count)
+		for j := 0; j < count; j++ {
+			req := stubs.HaloRequest{ID: stubs.StripID{Run: 1, Index: j}, Top: bottoms[(j-1+count)%count], Bottom: tops[(j+1)%count]}
+			if err := store.StepStrip(req, &responses[j]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for j, res := range responses {
+			tops[j], bottoms[j] = res.Top, res.Bottom
+		}
+	}
+
+	for j := 0; j < count; j++ {
+		res := new(stubs.StripResponse)
+		if err := store.CollectStrip(stubs.StripRequest{ID: stubs.StripID{Run: 1, Index: j}}, res); err != nil {
+			t.Fatal(err)
+		}
+		if res.StartY != bounds[j] || !reflect.DeepEqual(res.Rows.Words, expected.Rows(bounds[j], bounds[j+1]).Words) {
+			t.Fatalf("strip %d from row %d differs from the world stepped whole", j, res.StartY)
+		}
+		if err := store.DropStrip(stubs.StripRequest{ID: stubs.StripID{Run: 1, Index: j}}, new(stubs.StripResponse)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.CollectStrip(stubs.StripRequest{ID: stubs.StripID{Run: 1, Index: 0}}, new(stubs.StripResponse)); err == nil {
+		t.Fatalf("a dropped strip was collected")
+	}
+}
+
+// TestStoreRejects checks that strips and halos of the wrong size are refused.
+func TestStoreRejects(t *testing.T) {
+	store := NewStore(1)
+	rows := randomWorld(70, 4, 3)
+	id := stubs.StripID{Run: 1}
+	if err := store.LoadStrip(stubs.StripRequest{ID: id, StartY: 0, EndY: 5, Width: 70, Rows: rows}, new(stubs.StripResponse)); err == nil {
+		t.Errorf("a strip of 4 rows was loaded as rows 0 to 5")
+	}
+	if err := store.LoadStrip(stubs.StripRequest{ID: id, StartY: 0, EndY: 4, Width: 64, Rows: rows}, new(stubs.StripResponse)); err == nil {
+		t.Errorf("a strip 70 cells wide was loaded as 64 cells wide")
+	}
+	if err := store.LoadStrip(stubs.StripRequest{ID: id, StartY: 0, EndY: 4, Width: 70, Rows: rows}, new(stubs.StripResponse)); err != nil {
+		t.Fatal(err)
+	}
+	short := make([]uint64, 1)
+	if err := store.StepStrip(stubs.HaloRequest{ID: id, Top: short, Bottom: short}, new(stubs.HaloResponse)); err == nil {
+		t.Errorf("a strip 70 cells wide was stepped with halos of one word")
+	}
+	if err := store.StepStrip(stubs.HaloRequest{ID: stubs.StripID{Run: 2}}, new(stubs.HaloResponse)); err == nil {
+		t.Errorf("a strip that was never loaded was stepped")
+	}
+}
+
+// TestStepStripThreads steps the same strip split between different numbers of goroutines,
+// including more goroutines than rows and the store's own setting, and checks they agree.
+func TestStepStripThreads(t *testing.T) {
+	world := randomWorld(70, 12, 4)
+	var expected *stubs.HaloResponse
+	for _, threads := range []int{1, 0, 5, 12, 100} {
+		store := NewStore(3)
+		id := stubs.StripID{Run: 1}
+		req := stubs.StripRequest{ID: id, StartY: 0, EndY: world.Height, Width: world.Width, Rows: world}
+		if err := store.LoadStrip(req, new(stubs.StripResponse)); err != nil {
+			t.Fatal(err)
+		}
+		res := new(stubs.HaloResponse)
+		step := stubs.HaloRequest{ID: id, Top: world.Row(world.Height - 1), Bottom: world.Row(0), Flipped: true, Threads: threads}
+		if err := store.StepStrip(step, res); err != nil {
+			t.Fatal(err)
+		}
+		if expected == nil {
+			expected = res
+		} else if !reflect.DeepEqual(res, expected) {
+			t.Fatalf("the strip stepped by %d goroutines differs from the strip stepped by one", threads)
+		}
+	}
+}
+
+// halo returns row y of the world as the broker passes it on, looking across the top or
+// bottom edge for the rows just beyond them.
+func halo(world *util.BitGrid, topology util.Topology, y int) []uint64 {
+	if y >= 0 && y < world.Height {
+		return world.Row(y)
+	}
+	row := world.Row((y + world.Height) % world.Height)
+	if across := topology.AcrossY(row, world.Width); across != nil {
+		return across
+	}
+	return make([]uint64, util.WordsPerRow(world.Width))
+}
+
+// beyondX returns the cells just beyond the west and east edges of rows startY up to endY,
+// from the row above them to the row below.
+func beyondX(world *util.BitGrid, topology util.Topology, startY, endY int) ([]uint64, []uint64) {
+	west := make([]uint64, util.WordsPerRow(endY-startY+2))
+	east := make([]uint64, util.WordsPerRow(endY-startY+2))
+	for y := startY - 1; y <= endY; y++ {
+		if x, y2, ok := topology.Locate(-1, y, world.Width, world.Height); ok {
+			util.SetRowCell(west, y-startY+1, world.Get(x, y2))
+		}
+		if x, y2, ok := topology.Locate(world.Width, y, world.Width, world.Height); ok {
+			util.SetRowCell(east, y-startY+1, world.Get(x, y2))
+		}
+	}
+	return west, east
+}
+
+func randomWorld(width, height int, seed int64) *util.BitGrid {
+	random := rand.New(rand.NewSource(seed))
+	world := util.NewBitGrid(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			world.Set(x, y, random.Intn(3) == 0)
+		}
+	}
+	return world
+}
@@ -1,21 +1,43 @@
+//go:build worker
+
+// The broker and the worker are separate programs sharing this directory. Run each with
+// go run on its own file; go build and go test pick the worker with the worker build tag.
+
 package main
 
 import (
-	"errors"
 	"flag"
 	"log"
 	"net"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+	"uk.ac.bris.cs/gameoflife/gol/server/strips"
 	"uk.ac.bris.cs/gameoflife/gol/stubs"
 )
 
-type GameOfLifeOperations struct{}
+// GameOfLifeOperations is the RPC service of a worker. The strips it steps for the broker
+// are kept by the embedded store.
+type GameOfLifeOperations struct {
+	*strips.Store
+}
 
 func main() {
 	// Define the address and port the server will listen on
 	pAddr := flag.String("port", "8040", "Port to listen on")
+	pBroker := flag.String("broker", "", "Address of the broker to register with (host:port)")
+	pAdvertise := flag.String("advertise", "", "Address the broker should use to reach this worker. Defaults to the local IP used to reach the broker")
+	pCapacity := flag.Int("capacity", 1, "Share of the world this worker takes relative to the other workers")
+	pThreads := flag.Int("threads", runtime.NumCPU(), "Number of goroutines to split each strip between, unless the broker asks for a number")
+	flag.StringVar(&stubs.Compression, "compression", stubs.Compression, "Encoding to use for worlds on connections that support it: flate or none")
 	flag.Parse()
-	gameLife := new(GameOfLifeOperations)
+	if *pCapacity < 1 {
+		log.Fatalf("Capacity must be at least 1, got %d", *pCapacity)
+	}
+	gameLife := &GameOfLifeOperations{strips.NewStore(*pThreads)}
 	err := rpc.Register(gameLife)
 	if err != nil {
 		log.Fatalf("Error registering GameOfLifeOperations: %v", err)
@@ -30,6 +52,10 @@ func main() {
 
 	log.Printf("Server is listening on port %s...\n", *pAddr)
 
+	if *pBroker != "" {
+		go announce(*pBroker, *pAdvertise, *pAddr, *pCapacity)
+	}
+
 	// Accept incoming connections and handle RPC requests
 	for {
 		conn, err := listener.Accept()
@@ -40,81 +66,79 @@ func main() {
 
 		// Serve the connection using RPC
 		log.Printf("Connected! connection: %v", conn)
-		go rpc.ServeConn(conn)
+		go stubs.ServeConn(conn)
 	}
 }
 
-func (g *GameOfLifeOperations) ProcessGameOfLife(req stubs.Request, res *stubs.Response) (err error) {
-	if req.NextWorld == nil {
-		err = errors.New("no final board recieved")
-		return
-	}
-
-	nextWorld := req.NextWorld
-	turns := req.Turns
-	workerId := req.WorkerNumber
-	threadCount := 4
-
-	log.Printf("workers stuff:\n", turns, workerId, threadCount)
-
-	nextWorld = calculateNextState(workerId, nextWorld, threadCount)
-
-	// Set the FinalWorld and Turns in the response
-	res.FinalWorld = nextWorld
-	res.TurnsCompleted = turns
-
+// Shutdown stops the worker when the broker is shutting the whole system down.
+func (g *GameOfLifeOperations) Shutdown(req stubs.ControlRequest, res *stubs.ControlResponse) (err error) {
+	log.Printf("Shutting down\n")
+	// Give the reply a moment to reach the broker before exiting.
+	time.AfterFunc(100*time.Millisecond, func() {
+		os.Exit(0)
+	})
 	return
 }
 
-func calculateNextState(workerNumber int, world [][]byte, threadCount int) [][]byte {
-	// Create a new grid to store the next state of the world
-	size := len(world)
-	nextWorld := make([][]byte, size)
-	for i := range nextWorld {
-		nextWorld[i] = make([]byte, size)
-	}
+// announce registers this worker with the broker, keeps it alive with heartbeats
+// and deregisters it when the process is interrupted.
+func announce(brokerAddr string, advertiseAddr string, port string, capacity int) {
+	var client *rpc.Client
+	var address string
+	registered := false
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGTERM, syscall.SIGINT)
+	ticker := time.NewTicker(stubs.HeartbeatInterval)
+	defer ticker.Stop()
 
-	// Iterate over each cell in the grid
-	for y := workerNumber * size / threadCount; y < (workerNumber+1)*size/threadCount; y++ {
-		for x := 0; x < size; x++ {
-			sum := 0
-
-			// Iterate over the 3x3 neighborhood
-			for i := -1; i <= 1; i++ {
-				for j := -1; j <= 1; j++ {
-					// Skip the center cell itself (y, x)
-					if i == 0 && j == 0 {
-						continue
-					}
-
-					// Calculate wrapped coordinates using modulo
-					ny := (y + i + size) % size
-					nx := (x + j + size) % size
-
-					// Sum the neighbor value (wrapped around)
-					if world[ny][nx] == 255 {
-						sum++
-					}
+	for {
+		if client == nil {
+			conn, err := net.DialTimeout("tcp", brokerAddr, stubs.HeartbeatInterval)
+			if err != nil {
+				log.Printf("Error connecting to broker %s: %v\n", brokerAddr, err)
+			} else if client, err = stubs.NewClient(conn); err != nil {
+				log.Printf("Error connecting to broker %s: %v\n", brokerAddr, err)
+			} else {
+				address = advertiseAddr
+				if address == "" {
+					address = net.JoinHostPort(conn.LocalAddr().(*net.TCPAddr).IP.String(), port)
 				}
 			}
+		}
 
-			// Apply the Game of Life rules to the current cell
-			if world[y][x] == 255 { // Cell is alive
-				if sum < 2 || sum > 3 {
-					nextWorld[y][x] = 0 // Cell dies
-				} else {
-					nextWorld[y][x] = 255 // Cell stays alive
+		if client != nil {
+			req := stubs.WorkerRequest{Address: address, Capacity: capacity}
+			res := new(stubs.WorkerResponse)
+			method := stubs.Heartbeat
+			if !registered {
+				method = stubs.RegisterWorker
+			}
+			if err := client.Call(method, req, res); err != nil {
+				log.Printf("Error contacting broker %s: %v\n", brokerAddr, err)
+				client.Close()
+				client = nil
+				registered = false
+			} else {
+				if !registered {
+					log.Printf("Registered with broker %s as %s with capacity %d\n", brokerAddr, address, capacity)
 				}
-			} else { // Cell is dead
-				if sum == 3 {
-					nextWorld[y][x] = 255 // Cell becomes alive
-				} else {
-					nextWorld[y][x] = 0 // Cell stays dead
+				// The broker forgets workers it has not heard from, so register again.
+				registered = res.Registered
+			}
+		}
+
+		select {
+		case <-interrupt:
+			if client != nil {
+				err := client.Call(stubs.DeregisterWorker, stubs.WorkerRequest{Address: address}, new(stubs.WorkerResponse))
+				if err != nil {
+					log.Printf("Error deregistering from broker %s: %v\n", brokerAddr, err)
 				}
+				client.Close()
 			}
+			os.Exit(0)
+		case <-ticker.C:
 		}
 	}
-	// Return the next state of the world
-	return nextWorld
-
 }
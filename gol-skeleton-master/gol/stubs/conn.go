@@ -0,0 +1,164 @@
+package stubs
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+// Encodings a connection can negotiate. Worlds are mostly empty, so even the bit-packed form
+// shrinks a long way under flate.
+const (
+	CompressionNone  = "none"
+	CompressionFlate = "flate"
+)
+
+// Compression is the encoding this process offers when it connects, and the one it accepts
+// from others.
+var Compression = CompressionFlate
+
+// handshake starts every connection that negotiates an encoding. Connections without it
+// are plain gob, as sent by rpc.Dial.
+const handshake = "GOLRPC/1 "
+
+// handshakeTimeout is how long a server waits for the rest of a handshake once a client has
+// started sending, and how long NewClient waits for the reply.
+var handshakeTimeout = 5 * time.Second
+
+// NewClient negotiates an encoding on a new connection and returns an RPC client using it.
+func NewClient(conn net.Conn) (*rpc.Client, error) {
+	return newClient(conn, Compression, handshakeTimeout)
+}
+
+// newClient offers an encoding on a new connection, waiting up to timeout for the server to
+// reply with the encoding it picked.
+func newClient(conn net.Conn, offer string, timeout time.Duration) (*rpc.Client, error) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.WriteString(conn, handshake+offer+"\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	encoding, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	stream, err := wrap(conn, reader, strings.TrimSpace(encoding))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(stream), nil
+}
+
+// Dial connects to an RPC server and negotiates an encoding with it, giving up on either
+// after timeout.
+func Dial(address string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, Compression, timeout)
+}
+
+// ServeConn serves RPC requests on conn using the encoding the client asks for, if this
+// process accepts it, and plain gob otherwise.
+func ServeConn(conn net.Conn) {
+	serveConn(conn, Compression)
+}
+
+// serveConn serves RPC requests on conn, agreeing to the accept encoding if the client offers it.
+func serveConn(conn net.Conn, accept string) {
+	// A plain gob client may connect long before its first call, so nothing is timed until the
+	// client starts sending.
+	reader := bufio.NewReader(conn)
+	if _, err := reader.Peek(1); err != nil {
+		conn.Close()
+		return
+	}
+
+	// Anything that doesn't start with a whole handshake in time is taken as plain gob.
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	start, _ := reader.Peek(len(handshake))
+	if string(start) != handshake {
+		_ = conn.SetReadDeadline(time.Time{})
+		rpc.ServeConn(&bufferedConn{Conn: conn, reader: reader})
+		return
+	}
+
+	line, err := reader.ReadString('\n')
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	encoding := CompressionNone
+	if strings.TrimSpace(strings.TrimPrefix(line, handshake)) == accept {
+		encoding = accept
+	}
+	if _, err := io.WriteString(conn, encoding+"\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	stream, err := wrap(conn, reader, encoding)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	rpc.ServeConn(stream)
+}
+
+// wrap applies an encoding to a connection, reading through reader so nothing it has buffered is lost.
+func wrap(conn net.Conn, reader *bufio.Reader, encoding string) (io.ReadWriteCloser, error) {
+	switch encoding {
+	case CompressionNone:
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	case CompressionFlate:
+		writer, err := flate.NewWriter(conn, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		return &flateConn{Conn: conn, reader: flate.NewReader(reader), writer: writer}, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+// bufferedConn reads a connection through a buffer that may already hold some of its bytes.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// flateConn compresses everything written to a connection. Every write is flushed,
+// so each RPC message reaches the other side as soon as it is sent.
+type flateConn struct {
+	net.Conn
+	reader io.ReadCloser
+	writer *flate.Writer
+}
+
+func (c *flateConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *flateConn) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
@@ -0,0 +1,142 @@
+package stubs
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TestPlainClient connects with rpc.Dial, which sends no handshake, and waits longer than the
+// handshake timeout before its first call. It checks the call is still served as plain gob.
+func TestPlainClient(t *testing.T) {
+	defer func(timeout time.Duration) { handshakeTimeout = timeout }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+	addr := startEchoServer(t, CompressionFlate)
+
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	time.Sleep(4 * handshakeTimeout)
+	echo(t, client, randomGrid(100, 30, 1))
+}
+
+// TestCompressionMismatch connects clients and servers offering and accepting different
+// encodings, and checks they settle on one that both understand.
+func TestCompressionMismatch(t *testing.T) {
+	tests := []struct {
+		offer  string
+		accept string
+	}{
+		{CompressionFlate, CompressionFlate},
+		{CompressionFlate, CompressionNone},
+		{CompressionNone, CompressionFlate},
+		{CompressionNone, CompressionNone},
+		{"zstd", CompressionFlate},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v-%v", test.offer, test.accept), func(t *testing.T) {
+			addr := startEchoServer(t, test.accept)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := newClient(conn, test.offer, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			echo(t, client, randomGrid(100, 30, 2))
+		})
+	}
+}
+
+// TestFlateWorlds sends worlds through a flate connection and back, from empty to full and
+// from a single cell to a world larger than the flate window.
+func TestFlateWorlds(t *testing.T) {
+	addr := startEchoServer(t, CompressionFlate)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newClient(conn, CompressionFlate, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	full := util.NewBitGrid(70, 70)
+	for y := 0; y < full.Height; y++ {
+		for x := 0; x < full.Width; x++ {
+			full.Set(x, y, true)
+		}
+	}
+	for _, world := range []*util.BitGrid{util.NewBitGrid(1, 1), util.NewBitGrid(5120, 5120), full, randomGrid(1024, 1024, 3), randomGrid(3, 500, 4)} {
+		echo(t, client, world)
+	}
+}
+
+// Echo sends worlds straight back to the client.
+type Echo struct{}
+
+func (e *Echo) World(world util.BitGrid, res *util.BitGrid) error {
+	*res = world
+	return nil
+}
+
+var registerEcho sync.Once
+
+// startEchoServer serves Echo on a loopback port, agreeing to the accept encoding when a client
+// offers it. It returns the address to connect to.
+func startEchoServer(t *testing.T, accept string) string {
+	registerEcho.Do(func() {
+		if err := rpc.Register(new(Echo)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, accept)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// echo sends a world to the echo server and checks it comes back unchanged.
+func echo(t *testing.T, client *rpc.Client, world *util.BitGrid) {
+	res := new(util.BitGrid)
+	if err := client.Call("Echo.World", world, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Width != world.Width || res.Height != world.Height || !reflect.DeepEqual(res.Words, world.Words) {
+		t.Fatalf("a %dx%d world came back as a different %dx%d world", world.Width, world.Height, res.Width, res.Height)
+	}
+}
+
+func randomGrid(width, height int, seed int64) *util.BitGrid {
+	random := rand.New(rand.NewSource(seed))
+	world := util.NewBitGrid(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			world.Set(x, y, random.Intn(3) == 0)
+		}
+	}
+	return world
+}
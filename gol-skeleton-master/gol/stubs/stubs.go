@@ -1,41 +1,183 @@
 package stubs
 
-import "uk.ac.bris.cs/gameoflife/util"
+import (
+	"time"
+
+	"uk.ac.bris.cs/gameoflife/util"
+)
 
 var StartMaster = "GolMasterRunner.MasterStart"
-var StartWorker = "GameOfLifeOperations.ProcessGameOfLife"
+var LoadStrip = "GameOfLifeOperations.LoadStrip"
+var StepStrip = "GameOfLifeOperations.StepStrip"
+var CollectStrip = "GameOfLifeOperations.CollectStrip"
+var DropStrip = "GameOfLifeOperations.DropStrip"
 var RunTicker = "GolMasterRunner.TickTime"
+var RegisterWorker = "GolMasterRunner.RegisterWorker"
+var DeregisterWorker = "GolMasterRunner.DeregisterWorker"
+var Heartbeat = "GolMasterRunner.Heartbeat"
+var Pause = "GolMasterRunner.Pause"
+var Resume = "GolMasterRunner.Resume"
+var Snapshot = "GolMasterRunner.Snapshot"
+var Detach = "GolMasterRunner.Detach"
+var Shutdown = "GolMasterRunner.Shutdown"
+var Attach = "GolMasterRunner.Attach"
+var Wait = "GolMasterRunner.Wait"
+var PollEvents = "GolMasterRunner.PollEvents"
+var ShutdownWorker = "GameOfLifeOperations.Shutdown"
 
-type Response struct {
-	WorkerNumber   int
-	FinalWorld     [][]byte
-	TurnsCompleted int
-}
+// HeartbeatInterval is how often a registered worker reports to the broker.
+// A worker that stays silent for HeartbeatTimeout is dropped from the registry.
+const HeartbeatInterval = 2 * time.Second
+const HeartbeatTimeout = 3 * HeartbeatInterval
 
+// AliveResponse reports the latest completed turn of a session, out of Turns.
 type AliveResponse struct {
 	AliveCellCount int
 	CurrentTurns   int
+	Turns          int
+	Paused         bool
+	Finished       bool
 }
 
+// AliveRequest addresses a session on the broker. An empty SessionID means the latest session.
 type AliveRequest struct {
-	TimeToRequest bool
-}
-
-type Request struct {
-	WorkerNumber int
-	NextWorld    [][]byte
-	Turns        int
-	ThreadCount  int
+	SessionID string
 }
 
 type FinalResponse struct {
-	FinalWorld     [][]byte
+	FinalWorld     *util.BitGrid
 	TurnsCompleted int
 	AliveCells     []util.Cell
+	FailedWorkers  []string
 }
 
 type InitialRequest struct {
-	NextWorld   [][]byte
+	NextWorld   *util.BitGrid
+	Width       int
+	Height      int
 	Turns       int
 	ThreadCount int
+	SkipFrames  bool      // merge turns together instead of waiting when the controller falls behind
+	Rule        util.Rule // Life when left as the zero Rule
+	Topology    util.Topology
+}
+
+// EventKind says which controller event a SessionEvent stands for.
+type EventKind int
+
+const (
+	TurnCompleteEvent EventKind = iota
+	CellsFlippedEvent
+	AliveCellsCountEvent
+	StateChangeEvent
+	WorkerFailedEvent
+	CellsChangedEvent
+)
+
+// SessionEvent is a progress update from a session on the broker. Only the fields for its Kind are set.
+type SessionEvent struct {
+	Kind       EventKind
+	Turn       int
+	Cells      []util.Cell
+	States     []uint8 // new state of each of Cells, for CellsChangedEvent
+	AliveCount int
+	Paused     bool
+	Worker     string
+}
+
+// PollRequest asks for the events of a session after sequence number After, acknowledging the rest.
+type PollRequest struct {
+	SessionID string
+	After     int
+}
+
+// PollResponse carries the next batch of events. Last is the sequence number of the last event in the
+// batch, and Finished is set once the session has ended and every event has been acknowledged.
+type PollResponse struct {
+	Events   []SessionEvent
+	Last     int
+	Finished bool
+}
+
+// StartResponse identifies the session MasterStart created for a run.
+type StartResponse struct {
+	SessionID string
+}
+
+// WorkerRequest announces a worker. Capacity is its share of the world relative to the other workers.
+type WorkerRequest struct {
+	Address  string
+	Capacity int
+}
+
+type WorkerResponse struct {
+	Registered bool
+}
+
+// StripID identifies a strip of the world held by a worker.
+type StripID struct {
+	Run   int64
+	Index int
+}
+
+// StripRequest carries the rows a worker owns, world rows StartY up to EndY.
+// Every row is Width cells wide.
+type StripRequest struct {
+	ID       StripID
+	StartY   int
+	EndY     int
+	Width    int
+	Rows     *util.BitGrid
+	Rule     util.Rule
+	Topology util.Topology
+}
+
+type StripResponse struct {
+	ID     StripID
+	StartY int
+	Rows   *util.BitGrid
+}
+
+// HaloRequest asks a worker to advance its strip by one turn.
+// Top and Bottom are the rows directly above and below the strip. When the topology twists
+// the west and east edges, West and East are the cells just beyond those edges, packed like
+// a row with the row above the strip first and the row below it last.
+type HaloRequest struct {
+	ID      StripID
+	Top     []uint64
+	Bottom  []uint64
+	West    []uint64
+	East    []uint64
+	Flipped bool // report the cells that changed state
+	Threads int  // goroutines to split the strip between, or 0 for the worker's own setting
+}
+
+// HaloResponse returns the new edge rows of a strip after a turn, and its new west and east
+// columns when the topology twists those edges.
+type HaloResponse struct {
+	Top        []uint64
+	Bottom     []uint64
+	West       []uint64
+	East       []uint64
+	AliveCount int
+	Flipped    []util.Cell
+}
+
+// ControlRequest addresses a session on the broker. An empty SessionID means the latest session.
+type ControlRequest struct {
+	SessionID string
+}
+
+// ControlResponse reports the turn at which the broker acted on a control request.
+// World is only filled in by Snapshot and Attach, Turns, Paused, Rule and Topology only by Attach.
+type ControlResponse struct {
+	SessionID string
+	Turn      int
+	World     *util.BitGrid
+	Origin    util.Cell       // the position of the top left cell of World, in an unbounded world
+	States    *util.StateGrid // the states of every cell, when running a Generations rule
+	Turns     int
+	Paused    bool
+	Rule      util.Rule
+	Topology  util.Topology
 }
@@ -1,107 +1,350 @@
-package main
+package gol
 
 import (
 	"errors"
-	"flag"
 	"log"
-	"net"
-	"net/rpc"
+	"sync"
+	"time"
+
 	"uk.ac.bris.cs/gameoflife/gol/stubs"
+	"uk.ac.bris.cs/gameoflife/util"
 )
 
-type GameOfLifeOperations struct{}
+// localEngine runs the Game of Life in this process when no broker is configured. It answers the
+// same controls as a session on the broker and produces the same stream of events.
+type localEngine struct {
+	controls chan localControl
+	done     chan struct{}
+}
+
+type localControl struct {
+	method string
+	reply  chan stubs.ControlResponse
+}
+
+// aliveInterval is how often the alive cell count is reported.
+const aliveInterval = 2 * time.Second
+
+// stepper moves the world of the local engine on.
+type stepper interface {
+	// step moves the world on by at most limit turns. It returns how many turns it took, an
+	// event listing the cells that changed and the number of cells now alive.
+	step(limit int) (int, stubs.SessionEvent, int)
+	// world returns the world and the position of its top left cell, which is (0, 0) unless the
+	// world is unbounded.
+	world() (*util.BitGrid, util.Cell)
+	// states returns the state of every cell under a Generations rule, and nil otherwise.
+	states() *util.StateGrid
+}
+
+// gridStepper steps a packed world one turn at a time on threads goroutines.
+type gridStepper struct {
+	grid     *util.BitGrid
+	threads  int
+	rule     util.Rule
+	topology util.Topology
+}
+
+func (g *gridStepper) step(limit int) (int, stubs.SessionEvent, int) {
+	var flipped []util.Cell
+	var aliveCount int
+	g.grid, flipped, aliveCount = calculateNextState(g.grid, g.threads, g.rule, g.topology)
+	return 1, stubs.SessionEvent{Kind: stubs.CellsFlippedEvent, Cells: flipped}, aliveCount
+}
 
-func main() {
-	// Define the address and port the server will listen on
-	pAddr := flag.String("port", "8040", "Port to listen on")
-	flag.Parse()
-	gameLife := new(GameOfLifeOperations)
-	err := rpc.Register(gameLife)
-	if err != nil {
-		log.Fatalf("Error registering GameOfLifeOperations: %v", err)
+func (g *gridStepper) world() (*util.BitGrid, util.Cell) {
+	return g.grid, util.Cell{}
+}
+
+func (g *gridStepper) states() *util.StateGrid {
+	return nil
+}
+
+// generationsStepper steps a world under a Generations rule one turn at a time on threads goroutines.
+type generationsStepper struct {
+	grid     *util.StateGrid
+	threads  int
+	rule     util.Rule
+	topology util.Topology
+}
+
+func (g *generationsStepper) step(limit int) (int, stubs.SessionEvent, int) {
+	var changed []util.Cell
+	var states []uint8
+	var aliveCount int
+	g.grid, changed, states, aliveCount = calculateNextStates(g.grid, g.threads, g.rule, g.topology)
+	return 1, stubs.SessionEvent{Kind: stubs.CellsChangedEvent, Cells: changed, States: states}, aliveCount
+}
+
+func (g *generationsStepper) world() (*util.BitGrid, util.Cell) {
+	return g.grid.Alive(), util.Cell{}
+}
+
+func (g *generationsStepper) states() *util.StateGrid {
+	return g.grid
+}
+
+// hashStepper steps a world with HashLife, jumping as many turns at once as it can manage
+// while still keeping the window up to date.
+type hashStepper struct {
+	life *util.HashLife
+	// k is the log2 of the number of turns to jump next.
+	k int
+}
+
+// hashStepTime is roughly how long a HashLife jump should take. Jumps double in length while
+// they are quicker than this and halve when they are much slower.
+const hashStepTime = 50 * time.Millisecond
+
+func (h *hashStepper) step(limit int) (int, stubs.SessionEvent, int) {
+	k := h.k
+	for 1<<uint(k) > limit || k > h.life.MaxStep() {
+		k--
+	}
+	start := time.Now()
+	flipped := h.life.Step(k)
+	if elapsed := time.Since(start); elapsed < hashStepTime && k == h.k && h.k < 62 {
+		h.k++
+	} else if elapsed > 4*hashStepTime && h.k > 0 {
+		h.k--
 	}
+	return 1 << uint(k), stubs.SessionEvent{Kind: stubs.CellsFlippedEvent, Cells: flipped}, h.life.PopCount()
+}
+
+func (h *hashStepper) world() (*util.BitGrid, util.Cell) {
+	return h.life.Grid(), util.Cell{}
+}
+
+func (h *hashStepper) states() *util.StateGrid {
+	return nil
+}
+
+// sparseStepper steps an unbounded world one turn at a time on threads goroutines.
+type sparseStepper struct {
+	sparse  *util.SparseWorld
+	threads int
+	rule    util.Rule
+	// width and height are the size of the initial viewport, which stands in for the world
+	// once every cell has died.
+	width, height int
+}
+
+func (s *sparseStepper) step(limit int) (int, stubs.SessionEvent, int) {
+	var flipped []util.Cell
+	s.sparse, flipped = s.sparse.Next(s.rule, s.threads)
+	return 1, stubs.SessionEvent{Kind: stubs.CellsFlippedEvent, Cells: flipped}, s.sparse.PopCount()
+}
 
-	// Start the listener
-	listener, err := net.Listen("tcp", ":"+*pAddr)
-	if err != nil {
-		log.Fatalf("Error starting listener: %v", err)
+// world returns the bounding box of the alive cells.
+func (s *sparseStepper) world() (*util.BitGrid, util.Cell) {
+	origin, width, height, ok := s.sparse.Bounds()
+	if !ok {
+		return util.NewBitGrid(s.width, s.height), util.Cell{}
 	}
-	defer listener.Close()
+	return s.sparse.Grid(origin.X, origin.Y, width, height), origin
+}
 
-	log.Printf("Server is listening on port %s...\n", *pAddr)
+func (s *sparseStepper) states() *util.StateGrid {
+	return nil
+}
 
-	// Accept incoming connections and handle RPC requests
-	for {
-		conn, err := listener.Accept()
+// startLocal starts running the world with the engine chosen in p. Events are sent on polled
+// in batches and the result on finished, until stop is closed.
+func startLocal(p Params, world *util.StateGrid, polled chan<- []stubs.SessionEvent, finished chan<- Value, stop <-chan struct{}) *localEngine {
+	var s stepper
+	switch {
+	case p.Rule.Generations():
+		s = &generationsStepper{grid: world, threads: p.Threads, rule: p.Rule, topology: p.Topology}
+	case p.Engine == SparseEngine:
+		sparse := util.SparseWorldFromGrid(world.Alive(), 0, 0)
+		s = &sparseStepper{sparse: sparse, threads: p.Threads, rule: p.Rule, width: p.ImageWidth, height: p.ImageHeight}
+	case p.Engine != HashLifeEngine:
+		s = &gridStepper{grid: world.Alive(), threads: p.Threads, rule: p.Rule, topology: p.Topology}
+	default:
+		life, err := util.NewHashLife(world.Alive(), p.Rule, p.Topology)
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
-			continue //
+			log.Fatalf("Error starting the hashlife engine: %v", err)
 		}
+		s = &hashStepper{life: life}
+	}
+	e := &localEngine{controls: make(chan localControl), done: make(chan struct{})}
+	go e.run(p, s, polled, finished, stop)
+	return e
+}
 
-		log.Printf("Connected! connection: %v", conn)
-		go rpc.ServeConn(conn)
+func (e *localEngine) control(method string) (stubs.ControlResponse, error) {
+	req := localControl{method: method, reply: make(chan stubs.ControlResponse, 1)}
+	select {
+	case e.controls <- req:
+		return <-req.reply, nil
+	case <-e.done:
+		return stubs.ControlResponse{}, errors.New("the run has finished")
 	}
 }
 
-func (g *GameOfLifeOperations) ProcessGameOfLife(req stubs.Request, res *stubs.Response) (err error) {
-	if req.NextWorld == nil {
-		err = errors.New("no final board received")
-		return
+func (e *localEngine) run(p Params, s stepper, polled chan<- []stubs.SessionEvent, finished chan<- Value, stop <-chan struct{}) {
+	defer close(e.done)
+
+	turn := 0
+	aliveReported := time.Now()
+	paused := false
+	stopped := false
+	var pending []stubs.SessionEvent
+
+	handle := func(req localControl) {
+		switch req.method {
+		case stubs.Pause:
+			paused = true
+			pending = append(pending, stubs.SessionEvent{Kind: stubs.StateChangeEvent, Turn: turn, Paused: true})
+		case stubs.Resume:
+			paused = false
+			pending = append(pending, stubs.SessionEvent{Kind: stubs.StateChangeEvent, Turn: turn, Paused: false})
+		case stubs.Detach, stubs.Shutdown:
+			// Nothing else is attached to a local run, so leaving it ends it.
+			stopped = true
+		}
+		world, origin := s.world()
+		req.reply <- stubs.ControlResponse{Turn: turn, World: world, Origin: origin, States: s.states(), Turns: p.Turns, Paused: paused}
 	}
 
-	nextWorld := req.NextWorld
-	turns := req.Turns
-	workerId := req.WorkerNumber
-	threadCount := req.ThreadCount
+	// flush hands the pending events to the distributor, serving controls while it is busy.
+	flush := func() {
+		for len(pending) > 0 && !stopped {
+			select {
+			case polled <- pending:
+				pending = nil
+			case req := <-e.controls:
+				handle(req)
+			case <-stop:
+				stopped = true
+			}
+		}
+	}
 
-	nextWorld = calculateNextState(workerId, nextWorld, threadCount)
+	for {
+		flush()
+		select {
+		case req := <-e.controls:
+			handle(req)
+		case <-stop:
+			stopped = true
+		default:
+		}
+		for paused && !stopped {
+			flush()
+			select {
+			case req := <-e.controls:
+				handle(req)
+			case <-stop:
+				stopped = true
+			}
+		}
 
-	res.FinalWorld = nextWorld
-	res.TurnsCompleted = turns
-	return
+		if stopped {
+			return
+		}
+		if turn == p.Turns {
+			break
+		}
+
+		turns, cells, aliveCount := s.step(p.Turns - turn)
+		turn += turns
+
+		cells.Turn = turn
+		pending = append(pending, cells, stubs.SessionEvent{Kind: stubs.TurnCompleteEvent, Turn: turn})
+		if time.Since(aliveReported) >= aliveInterval {
+			aliveReported = time.Now()
+			pending = append(pending, stubs.SessionEvent{Kind: stubs.AliveCellsCountEvent, Turn: turn, AliveCount: aliveCount})
+		}
+	}
+
+	flush()
+	if !stopped {
+		world, origin := s.world()
+		cells := world.AliveCells(0)
+		for i := range cells {
+			cells[i].X += origin.X
+			cells[i].Y += origin.Y
+		}
+		finished <- Value{World: world, Origin: origin, States: s.states(), TurnCompleted: turn, AliveCells: cells}
+	}
 }
 
-func calculateNextState(workerNumber int, world [][]byte, threadCount int) [][]byte {
-	size := len(world)
-	nextWorld := make([][]byte, size)
-	for i := range nextWorld {
-		nextWorld[i] = make([]byte, size)
+// calculateNextState computes the next turn of the world under the rule and topology on threads
+// goroutines, each taking a band of rows. It returns the new world, the cells that flipped and
+// the alive count.
+func calculateNextState(world *util.BitGrid, threads int, rule util.Rule, topology util.Topology) (*util.BitGrid, []util.Cell, int) {
+	height := world.Height
+	nextWorld := util.NewBitGrid(world.Width, height)
+
+	if threads > height {
+		threads = height
+	}
+	if threads < 1 {
+		threads = 1
 	}
+	flipped := make([][]util.Cell, threads)
+	alive := make([]int, threads)
 
-	for y := workerNumber * size / threadCount; y < (workerNumber+1)*size/threadCount; y++ {
-		for x := 0; x < size; x++ {
-			sum := 0
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(t, startY, endY int) {
+			defer wg.Done()
+			topology.NextRows(rule, nextWorld, world, startY, endY)
+			band := nextWorld.Rows(startY, endY)
+			flipped[t] = world.Rows(startY, endY).FlippedCells(band, startY)
+			alive[t] = band.PopCount()
+		}(t, t*height/threads, (t+1)*height/threads)
+	}
+	wg.Wait()
 
-			for i := -1; i <= 1; i++ {
-				for j := -1; j <= 1; j++ {
-					if i == 0 && j == 0 {
-						continue
-					}
+	cells := []util.Cell{}
+	aliveCount := 0
+	for t := range flipped {
+		cells = append(cells, flipped[t]...)
+		aliveCount += alive[t]
+	}
+	return nextWorld, cells, aliveCount
+}
 
-					ny := (y + i + size) % size
-					nx := (x + j + size) % size
+// calculateNextStates computes the next turn of a world under a Generations rule and a topology
+// on threads goroutines, each taking a band of rows. It returns the new world, the cells that
+// changed with their new states, and the alive count.
+func calculateNextStates(world *util.StateGrid, threads int, rule util.Rule, topology util.Topology) (*util.StateGrid, []util.Cell, []uint8, int) {
+	height := world.Height
+	nextWorld := util.NewStateGrid(world.Width, height)
+	alive := world.Alive()
+	born := util.NewBitGrid(world.Width, height)
 
-					if world[ny][nx] == 255 {
-						sum++
-					}
-				}
-			}
+	if threads > height {
+		threads = height
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	changed := make([][]util.Cell, threads)
+	states := make([][]uint8, threads)
 
-			if world[y][x] == 255 { //cell is alive
-				if sum < 2 || sum > 3 {
-					nextWorld[y][x] = 0 //cell dies
-				} else {
-					nextWorld[y][x] = 255 //cell stays alive
-				}
-			} else { //cell is dead
-				if sum == 3 {
-					nextWorld[y][x] = 255 //cell becomes alive
-				} else {
-					nextWorld[y][x] = 0 //cell stays dead
-				}
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(t, startY, endY int) {
+			defer wg.Done()
+			topology.NextRows(rule, born, alive, startY, endY)
+			for y := startY; y < endY; y++ {
+				rule.NextStates(nextWorld.Row(y), world.Row(y), born.Row(y))
 			}
-		}
+			changed[t], states[t] = world.ChangedCells(nextWorld, startY, endY)
+		}(t, t*height/threads, (t+1)*height/threads)
 	}
-	return nextWorld
+	wg.Wait()
 
+	cells := []util.Cell{}
+	var cellStates []uint8
+	for t := range changed {
+		cells = append(cells, changed[t]...)
+		cellStates = append(cellStates, states[t]...)
+	}
+	return nextWorld, cells, cellStates, nextWorld.Alive().PopCount()
 }
@@ -42,3 +42,102 @@ func TestGol(t *testing.T) {
 		}
 	}
 }
+
+// TestGolNonSquare tests 128x64 and 512x16 images on 0, 1 and 100 turns against a reference computed here.
+func TestGolNonSquare(t *testing.T) {
+	tests := []gol.Params{
+		{ImageWidth: 128, ImageHeight: 64},
+		{ImageWidth: 512, ImageHeight: 16},
+	}
+	for _, p := range tests {
+		initialAlive := readAliveCells(
+			"images/"+fmt.Sprintf("%vx%v.pgm", p.ImageWidth, p.ImageHeight),
+			p.ImageWidth,
+			p.ImageHeight,
+		)
+		for _, turns := range []int{0, 1, 100} {
+			p.Turns = turns
+			expectedAlive := referenceAliveCells(initialAlive, p.ImageWidth, p.ImageHeight, turns)
+			for _, threads := range []int{1, 4, 8} {
+				p.Threads = threads
+				testName := fmt.Sprintf("%dx%dx%d-%d", p.ImageWidth, p.ImageHeight, p.Turns, p.Threads)
+				t.Run(testName, func(t *testing.T) {
+					events := make(chan gol.Event)
+					go gol.Run(p, events, nil)
+					var cells []util.Cell
+					for event := range events {
+						switch e := event.(type) {
+						case gol.FinalTurnComplete:
+							cells = e.Alive
+						}
+					}
+					assertEqualBoard(t, cells, expectedAlive, p)
+				})
+			}
+		}
+	}
+}
+
+// referenceAliveCells runs a straightforward single-threaded Game of Life on a width x height torus.
+func referenceAliveCells(alive []util.Cell, width, height, turns int) []util.Cell {
+	return referenceRuleAliveCells(alive, width, height, turns, util.Life)
+}
+
+// referenceRuleAliveCells runs a straightforward single-threaded life-like rule on a width x height torus.
+func referenceRuleAliveCells(alive []util.Cell, width, height, turns int, rule util.Rule) []util.Cell {
+	world := make([][]bool, height)
+	for y := range world {
+		world[y] = make([]bool, width)
+	}
+	for _, cell := range alive {
+		world[cell.Y][cell.X] = true
+	}
+
+	for turn := 0; turn < turns; turn++ {
+		next := make([][]bool, height)
+		for y := range next {
+			next[y] = make([]bool, width)
+			for x := range next[y] {
+				neighbours := 0
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						if (dy != 0 || dx != 0) && world[(y+dy+height)%height][(x+dx+width)%width] {
+							neighbours++
+						}
+					}
+				}
+				next[y][x] = rule.Next(world[y][x], neighbours)
+			}
+		}
+		world = next
+	}
+
+	var cells []util.Cell
+	for y := range world {
+		for x := range world[y] {
+			if world[y][x] {
+				cells = append(cells, util.Cell{X: x, Y: y})
+			}
+		}
+	}
+	return cells
+}
+
+// TestRules runs the 64x64 image under other rules with both local engines and checks the
+// result against the reference.
+func TestRules(t *testing.T) {
+	alive := readAliveCells("images/64x64.pgm", 64, 64)
+	for _, name := range []string{"B36/S23", "B2/S", "B3678/S34678", "B0123478/S01234678"} {
+		rule, err := util.ParseRule(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := referenceRuleAliveCells(alive, 64, 64, 20, rule)
+		for _, engine := range []string{gol.GridEngine, gol.HashLifeEngine} {
+			p := gol.Params{ImageWidth: 64, ImageHeight: 64, Turns: 20, Threads: 4, Engine: engine, Rule: rule}
+			t.Run(fmt.Sprintf("%v-%v", name, engine), func(t *testing.T) {
+				assertEqualBoard(t, finalAliveCells(p), expected, p)
+			})
+		}
+	}
+}
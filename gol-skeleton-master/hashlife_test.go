@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TestHashLife steps the test images with HashLife in jumps of different lengths and checks
+// every jump against the reference.
+func TestHashLife(t *testing.T) {
+	sizes := [][2]int{{16, 16}, {64, 64}, {128, 64}, {512, 16}}
+	for _, size := range sizes {
+		width, height := size[0], size[1]
+		t.Run(fmt.Sprintf("%dx%d", width, height), func(t *testing.T) {
+			alive := readAliveCells(fmt.Sprintf("images/%vx%v.pgm", width, height), width, height)
+			world := util.NewBitGrid(width, height)
+			for _, cell := range alive {
+				world.Set(cell.X, cell.Y, true)
+			}
+			life, err := util.NewHashLife(world, util.Life, util.Torus)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			turn := 0
+			for _, k := range []int{0, 0, 1, 3, 2, 5, 0, 4} {
+				before := life.AliveCells()
+				flipped := life.Step(k)
+				turn += 1 << uint(k)
+				expected := referenceAliveCells(alive, width, height, turn)
+				if !checkEqualBoard(life.AliveCells(), expected) {
+					t.Fatalf("turn %d differs from the reference", turn)
+				}
+				if life.PopCount() != len(expected) {
+					t.Fatalf("turn %d has a PopCount of %d, expected %d", turn, life.PopCount(), len(expected))
+				}
+				if len(flipped) != len(symmetricDifference(before, expected)) {
+					t.Fatalf("turn %d flipped %d cells, expected %d", turn, len(flipped), len(symmetricDifference(before, expected)))
+				}
+			}
+		})
+	}
+}
+
+// TestHashLifeEngine runs the main test images through the hashlife engine on a torus and a
+// plane, and a glider through the ten billion turns main.go defaults to.
+func TestHashLifeEngine(t *testing.T) {
+	for _, size := range []int{16, 64, 512} {
+		for _, turns := range []int{0, 1, 100} {
+			p := gol.Params{ImageWidth: size, ImageHeight: size, Turns: turns, Threads: 1, Engine: gol.HashLifeEngine}
+			t.Run(fmt.Sprintf("%dx%dx%d", size, size, turns), func(t *testing.T) {
+				expected := readAliveCells(fmt.Sprintf("check/images/%vx%vx%v.pgm", size, size, turns), size, size)
+				assertEqualBoard(t, finalAliveCells(p), expected, p)
+			})
+		}
+	}
+
+	for _, size := range [][2]int{{16, 16}, {64, 64}, {128, 64}} {
+		p := gol.Params{ImageWidth: size[0], ImageHeight: size[1], Turns: 100, Threads: 1, Engine: gol.HashLifeEngine, Topology: util.Plane}
+		t.Run(fmt.Sprintf("%v-%dx%dx%d", p.Topology, p.ImageWidth, p.ImageHeight, p.Turns), func(t *testing.T) {
+			expected := readAliveCells(
+				fmt.Sprintf("check/images/%v/%vx%vx%v.pgm", p.Topology, p.ImageWidth, p.ImageHeight, p.Turns),
+				p.ImageWidth,
+				p.ImageHeight,
+			)
+			assertEqualBoard(t, finalAliveCells(p), expected, p)
+		})
+	}
+
+	// The 16x16 image is a glider, which comes back to where it started every 64 turns.
+	p := gol.Params{ImageWidth: 16, ImageHeight: 16, Turns: 10000000000, Threads: 1, Engine: gol.HashLifeEngine}
+	t.Run("16x16x10000000000", func(t *testing.T) {
+		expected := readAliveCells("images/16x16.pgm", 16, 16)
+		assertEqualBoard(t, finalAliveCells(p), expected, p)
+	})
+}
+
+// finalAliveCells runs the Game of Life headless and returns the alive cells it finishes with.
+func finalAliveCells(p gol.Params) []util.Cell {
+	events := make(chan gol.Event)
+	go gol.Run(p, events, nil)
+	var cells []util.Cell
+	for event := range events {
+		if e, ok := event.(gol.FinalTurnComplete); ok {
+			cells = e.Alive
+		}
+	}
+	return cells
+}
+
+// symmetricDifference lists the cells in exactly one of a and b.
+func symmetricDifference(a, b []util.Cell) []util.Cell {
+	count := make(map[util.Cell]int)
+	for _, cell := range a {
+		count[cell]++
+	}
+	for _, cell := range b {
+		count[cell]--
+	}
+	var cells []util.Cell
+	for cell, n := range count {
+		if n != 0 {
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// TestInputPath starts runs from images given by path, with the size of the world taken from
+// the image, and checks that the output goes to the directory asked for.
+func TestInputPath(t *testing.T) {
+	for _, size := range [][2]int{{64, 64}, {128, 64}} {
+		width, height := size[0], size[1]
+		t.Run(fmt.Sprintf("%dx%d", width, height), func(t *testing.T) {
+			dir := t.TempDir()
+			p := gol.Params{Turns: 100, Threads: 4, InputPath: fmt.Sprintf("images/%vx%v.pgm", width, height), OutputDir: filepath.Join(dir, "images")}
+			expected := referenceAliveCells(readAliveCells(p.InputPath, width, height), width, height, 100)
+			assertEqualBoard(t, finalAliveCells(p), expected, p)
+			assertEqualBoard(t, readAliveCells(filepath.Join(dir, "images", fmt.Sprintf("%vx%vx100.pgm", width, height)), width, height), expected, p)
+		})
+	}
+
+	// The world is the size of the rle header, so the gun fills it.
+	t.Run("rle", func(t *testing.T) {
+		dir := t.TempDir()
+		writePattern(t, filepath.Join(dir, "gun.rle"), gosperGliderGun)
+		width, height, err := gol.ImageSize(filepath.Join(dir, "gun.rle"))
+		if err != nil || width != 36 || height != 9 {
+			t.Fatalf("the gun has a size of %dx%d (%v), expected 36x9", width, height, err)
+		}
+		p := gol.Params{Threads: 1, InputPath: filepath.Join(dir, "gun.rle"), OutputDir: dir}
+		if cells := finalAliveCells(p); len(cells) != 36 {
+			t.Fatalf("the gun has %d alive cells, expected 36", len(cells))
+		}
+		if _, err := os.Stat(filepath.Join(dir, "36x9x0.pgm")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -10,6 +10,7 @@ import (
 
 	"uk.ac.bris.cs/gameoflife/gol"
 	"uk.ac.bris.cs/gameoflife/sdl"
+	"uk.ac.bris.cs/gameoflife/util"
 )
 
 // main is the function called when starting Game of Life with 'go run .'
@@ -20,20 +21,20 @@ func main() {
 	flag.IntVar(
 		&params.Threads,
 		"t",
-		8,
-		"Specify the number of worker threads to use. Defaults to 8.")
+		0,
+		"Specify the number of worker threads to use. Defaults to 8 locally, and to the -threads of each worker on a broker.")
 
 	flag.IntVar(
 		&params.ImageWidth,
 		"w",
-		512,
-		"Specify the width of the image. Defaults to 512.")
+		0,
+		"Specify the width of the image. Defaults to the width of the -input image or of the session to -attach to, or 512.")
 
 	flag.IntVar(
 		&params.ImageHeight,
 		"h",
-		512,
-		"Specify the height of the image. Defaults to 512.")
+		0,
+		"Specify the height of the image. Defaults to the height of the -input image or of the session to -attach to, or 512.")
 
 	flag.IntVar(
 		&params.Turns,
@@ -41,6 +42,77 @@ func main() {
 		10000000000,
 		"Specify the number of turns to process. Defaults to 10000000000.")
 
+	flag.StringVar(
+		&params.Broker,
+		"broker",
+		"",
+		"Specify the address of the broker. Runs locally on this machine when empty.")
+
+	flag.BoolVar(
+		&params.Attach,
+		"attach",
+		false,
+		"Attach to the run already in progress on the broker instead of starting a new one.")
+
+	flag.StringVar(
+		&params.Session,
+		"session",
+		"",
+		"Specify the session to attach to. Defaults to the most recently started one.")
+
+	flag.BoolVar(
+		&params.SkipFrames,
+		"skipframes",
+		false,
+		"Skip frames in the SDL window instead of slowing the run down when the window falls behind.")
+
+	flag.StringVar(
+		&params.Engine,
+		"engine",
+		gol.GridEngine,
+		"Specify the engine for a local run: grid, hashlife for jumping through long runs of periodic patterns, or sparse for an unbounded world panned with the arrow keys.")
+
+	params.Rule = util.Life
+	flag.Var(
+		&params.Rule,
+		"rule",
+		"Specify the rule in B/S notation, such as B36/S23 for HighLife. Defaults to B3/S23.")
+
+	flag.Var(
+		&params.Topology,
+		"topology",
+		"Specify how the edges of the world join up: torus, plane, cylinder, klein or cross. Defaults to torus.")
+
+	flag.StringVar(
+		&params.Format,
+		"format",
+		gol.PgmFormat,
+		"Specify the format images are saved in: pgm, rle, cells, lif or mc. Input images are read in any of them.")
+
+	flag.Func(
+		"offset",
+		"Place a pattern read from an rle, cells, lif or mc file with its top left cell at x,y. Defaults to the middle of the world.",
+		func(s string) error {
+			var offset util.Cell
+			if _, err := fmt.Sscanf(s, "%d,%d", &offset.X, &offset.Y); err != nil {
+				return fmt.Errorf("offset %q is not of the form x,y", s)
+			}
+			params.Offset = &offset
+			return nil
+		})
+
+	flag.StringVar(
+		&params.InputPath,
+		"input",
+		"",
+		"Specify the image to start from, in any of the formats -format takes. Defaults to images/WxH.")
+
+	flag.StringVar(
+		&params.OutputDir,
+		"outdir",
+		"out",
+		"Specify the directory images are saved in. Defaults to out.")
+
 	headless := flag.Bool(
 		"headless",
 		false,
@@ -48,10 +120,24 @@ func main() {
 
 	flag.Parse()
 
+	// The SDL window needs the size of the world before the run starts.
+	params, err := params.WithImageSize()
+	if err != nil {
+		fmt.Println("Error finding the size of the world:", err)
+		os.Exit(1)
+	}
+
 	fmt.Printf("%-10v %v\n", "Threads", params.Threads)
 	fmt.Printf("%-10v %v\n", "Width", params.ImageWidth)
 	fmt.Printf("%-10v %v\n", "Height", params.ImageHeight)
 	fmt.Printf("%-10v %v\n", "Turns", params.Turns)
+	fmt.Printf("%-10v %v\n", "Broker", params.Broker)
+	fmt.Printf("%-10v %v\n", "Engine", params.Engine)
+	fmt.Printf("%-10v %v\n", "Rule", params.Rule)
+	fmt.Printf("%-10v %v\n", "Topology", params.Topology)
+	fmt.Printf("%-10v %v\n", "Format", params.Format)
+	fmt.Printf("%-10v %v\n", "Input", params.InputPath)
+	fmt.Printf("%-10v %v\n", "Output", params.OutputDir)
 
 	keyPresses := make(chan rune, 10)
 	events := make(chan gol.Event, 1000)
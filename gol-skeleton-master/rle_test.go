@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+const gosperGliderGun = `#N Gosper glider gun
+#C The first known gun, which fires a glider every 30 turns.
+x = 36, y = 9, rule = B3/S23
+24bo$22bobo$12b2o6b2o12b2o$11bo3bo4b2o12b2o$2o8bo5bo3b2o$2o8bo3bob2o4b
+obo$10bo5bo7bo$11bo3bo$12b2o!
+`
+
+// TestRle reads the Gosper glider gun from an rle file, in the middle of the world and at an
+// offset, and checks that it runs like the reference and comes back from an rle file it wrote.
+func TestRle(t *testing.T) {
+	dir := t.TempDir()
+	writePattern(t, filepath.Join(dir, "gun.rle"), gosperGliderGun)
+
+	p := gol.Params{ImageWidth: 64, ImageHeight: 48, Threads: 4, InputPath: filepath.Join(dir, "gun.rle"), OutputDir: dir}
+	gun := finalAliveCells(p)
+	if len(gun) != 36 {
+		t.Fatalf("the gun has %d alive cells, expected 36", len(gun))
+	}
+	for _, cell := range gun {
+		// The 36x9 gun sits in the middle of the 64x48 world.
+		if cell.X < 14 || cell.X >= 50 || cell.Y < 19 || cell.Y >= 28 {
+			t.Fatalf("(%d, %d) is outside the middle of the world", cell.X, cell.Y)
+		}
+	}
+
+	p.Offset = &util.Cell{X: 3, Y: 2}
+	t.Run("offset", func(t *testing.T) {
+		expected := make([]util.Cell, len(gun))
+		for i, cell := range gun {
+			expected[i] = util.Cell{X: cell.X - 11, Y: cell.Y - 17}
+		}
+		assertEqualBoard(t, finalAliveCells(p), expected, p)
+	})
+
+	p = gol.Params{ImageWidth: 64, ImageHeight: 48, Turns: 100, Threads: 4, Format: gol.RleFormat, InputPath: filepath.Join(dir, "gun.rle"), OutputDir: dir}
+	t.Run("64x48x100", func(t *testing.T) {
+		expected := referenceAliveCells(gun, 64, 48, 100)
+		assertEqualBoard(t, finalAliveCells(p), expected, p)
+
+		data, err := os.ReadFile(filepath.Join(dir, "64x48x100.rle"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), "x = 64, y = 48, rule = B3/S23\n") {
+			t.Fatalf("the rle file starts with %q", strings.SplitN(string(data), "\n", 2)[0])
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if len(line) > 70 {
+				t.Fatalf("the rle file has a line of %d characters", len(line))
+			}
+		}
+
+		p := gol.Params{Threads: 4, InputPath: filepath.Join(dir, "64x48x100.rle"), OutputDir: dir}
+		assertEqualBoard(t, finalAliveCells(p), expected, p)
+	})
+}
+
+// TestRleRule checks that the rule in an rle file is used, and that the states of a
+// Generations rule are written and read back.
+func TestRleRule(t *testing.T) {
+	dir := t.TempDir()
+	writePattern(t, filepath.Join(dir, "triominoes.rle"), "x = 4, y = 3, rule = B2/S/C3\n.2A$.A.A$A.A!\n")
+
+	rule := util.Rule{Birth: 1 << 2, States: 3}
+	start := []util.Cell{{X: 19, Y: 13}, {X: 20, Y: 13}, {X: 19, Y: 14}, {X: 21, Y: 14}, {X: 18, Y: 15}, {X: 20, Y: 15}}
+	expected := referenceStates(start, 40, 30, 20, rule)
+
+	p := gol.Params{ImageWidth: 40, ImageHeight: 30, Turns: 20, Threads: 4, Format: gol.RleFormat, InputPath: filepath.Join(dir, "triominoes.rle"), OutputDir: dir}
+	var expectedAlive []util.Cell
+	for y := range expected {
+		for x := range expected[y] {
+			if expected[y][x] == 1 {
+				expectedAlive = append(expectedAlive, util.Cell{X: x, Y: y})
+			}
+		}
+	}
+	assertEqualBoard(t, finalAliveCells(p), expectedAlive, p)
+
+	// The rle file written is the size of the world, so the cells come back where they were.
+	p = gol.Params{Threads: 4, InputPath: filepath.Join(dir, "40x30x20.rle"), OutputDir: dir}
+	events := make(chan gol.Event)
+	go gol.Run(p, events, nil)
+	states := make([][]uint8, 30)
+	for y := range states {
+		states[y] = make([]uint8, 40)
+	}
+	for event := range events {
+		if e, ok := event.(gol.CellsChanged); ok {
+			for i, cell := range e.Cells {
+				states[cell.Y][cell.X] = e.States[i]
+			}
+		}
+	}
+	for y := range expected {
+		for x := range expected[y] {
+			if states[y][x] != expected[y][x] {
+				t.Fatalf("(%d, %d) came back in state %d, expected %d", x, y, states[y][x], expected[y][x])
+			}
+		}
+	}
+}
+
+// TestRleBounds reads an rle file whose rule is followed by the bounds Golly gives a world,
+// which hold a comma of their own.
+func TestRleBounds(t *testing.T) {
+	dir := t.TempDir()
+	writePattern(t, filepath.Join(dir, "glider.rle"), "x = 3, y = 3, rule = B3/S23:T100,100\nbo$2bo$3o!\n")
+	start := []util.Cell{{X: 4, Y: 3}, {X: 5, Y: 4}, {X: 3, Y: 5}, {X: 4, Y: 5}, {X: 5, Y: 5}}
+	p := gol.Params{ImageWidth: 10, ImageHeight: 10, Turns: 4, Threads: 1, InputPath: filepath.Join(dir, "glider.rle"), OutputDir: dir}
+	assertEqualBoard(t, finalAliveCells(p), referenceAliveCells(start, 10, 10, 4), p)
+}
+
+func writePattern(t *testing.T, path, pattern string) {
+	if err := os.WriteFile(path, []byte(pattern), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
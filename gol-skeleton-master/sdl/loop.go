@@ -17,6 +17,40 @@ func Run(p gol.Params, events <-chan gol.Event, keyPresses chan<- rune) {
 	refreshTicker := time.NewTicker(time.Second / time.Duration(FPS))
 	avgTurns := util.NewAvgTurns()
 
+	// An unbounded world is drawn through a viewport the size of the window, which the arrow
+	// keys move about. Every alive cell is kept so the viewport can be redrawn after a move.
+	unbounded := p.Engine == gol.SparseEngine
+	alive := make(map[util.Cell]bool)
+	var viewport util.Cell
+	flip := func(cell util.Cell) {
+		if !unbounded {
+			w.FlipPixel(cell.X, cell.Y)
+			return
+		}
+		if alive[cell] {
+			delete(alive, cell)
+		} else {
+			alive[cell] = true
+		}
+		if x, y := cell.X-viewport.X, cell.Y-viewport.Y; x >= 0 && y >= 0 && x < int(w.Width) && y < int(w.Height) {
+			w.FlipPixel(x, y)
+		}
+	}
+	pan := func(dx, dy int) {
+		if !unbounded {
+			return
+		}
+		viewport.X += dx * int(w.Width) / 8
+		viewport.Y += dy * int(w.Height) / 8
+		w.ClearPixels()
+		for cell := range alive {
+			if x, y := cell.X-viewport.X, cell.Y-viewport.Y; x >= 0 && y >= 0 && x < int(w.Width) && y < int(w.Height) {
+				w.SetPixel(x, y)
+			}
+		}
+		dirty = true
+	}
+
 sdl:
 	for {
 		select {
@@ -38,6 +72,14 @@ sdl:
 						keyPresses <- 'q'
 					case sdl.K_k:
 						keyPresses <- 'k'
+					case sdl.K_LEFT:
+						pan(-1, 0)
+					case sdl.K_RIGHT:
+						pan(1, 0)
+					case sdl.K_UP:
+						pan(0, -1)
+					case sdl.K_DOWN:
+						pan(0, 1)
 					}
 				}
 			}
@@ -52,10 +94,15 @@ sdl:
 			}
 			switch e := event.(type) {
 			case gol.CellFlipped:
-				w.FlipPixel(e.Cell.X, e.Cell.Y)
+				flip(e.Cell)
 			case gol.CellsFlipped:
 				for _, cell := range e.Cells {
-					w.FlipPixel(cell.X, cell.Y) 
+					flip(cell)
+				}
+			case gol.CellsChanged:
+				for i, cell := range e.Cells {
+					red, green, blue := stateColour(p.Rule, e.States[i])
+					w.SetColour(cell.X, cell.Y, red, green, blue)
 				}
 			case gol.TurnComplete:
 				dirty = true
@@ -65,6 +112,8 @@ sdl:
 				fmt.Printf("Completed Turns %-8v %v\n", event.GetCompletedTurns(), event)
 			case gol.ImageOutputComplete:
 				fmt.Printf("Completed Turns %-8v %v\n", event.GetCompletedTurns(), event)
+			case gol.WorkerFailed:
+				fmt.Printf("Completed Turns %-8v %v\n", event.GetCompletedTurns(), event)
 			case gol.StateChange:
 				fmt.Printf("Completed Turns %-8v %v\n", event.GetCompletedTurns(), event)
 				if e.NewState == gol.Quitting {
@@ -75,6 +124,23 @@ sdl:
 	}
 }
 
+// stateColour picks the colour of a cell under a Generations rule: white when alive, black when
+// dead, and fading from yellow to dark red as it dies.
+func stateColour(rule util.Rule, state uint8) (uint8, uint8, uint8) {
+	switch state {
+	case 0:
+		return 0, 0, 0
+	case 1:
+		return 0xFF, 0xFF, 0xFF
+	}
+	// fade goes from 0 for the first dying state to 255 for the last.
+	fade := 255
+	if rule.States > 3 {
+		fade = 255 * (int(state) - 2) / (rule.States - 3)
+	}
+	return uint8(255 - fade*159/255), uint8(224 - fade*224/255), 0
+}
+
 func RunHeadless(events <-chan gol.Event) {
 	avgTurns := util.NewAvgTurns()
 	for event := range events {
@@ -85,6 +151,8 @@ func RunHeadless(events <-chan gol.Event) {
 			fmt.Printf("Completed Turns %-8v %v\n", event.GetCompletedTurns(), "Final Turn Complete")
 		case gol.ImageOutputComplete:
 			fmt.Printf("Completed Turns %-8v %v\n", event.GetCompletedTurns(), event)
+		case gol.WorkerFailed:
+			fmt.Printf("Completed Turns %-8v %v\n", event.GetCompletedTurns(), event)
 		case gol.StateChange:
 			fmt.Printf("Completed Turns %-8v %v\n", event.GetCompletedTurns(), event)
 			if e.NewState == gol.Quitting {
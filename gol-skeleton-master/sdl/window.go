@@ -88,6 +88,20 @@ func (w *Window) FlipPixel(x, y int) {
 	w.pixels[4*(y*width+x)+3] = ^w.pixels[4*(y*width+x)+3]
 }
 
+// SetColour sets the colour of a pixel, which is only drawn once the frame is rendered.
+func (w *Window) SetColour(x, y int, red, green, blue uint8) {
+	if x < 0 || y < 0 || x >= int(w.Width) || y >= int(w.Height) {
+		panic(fmt.Sprintf("CellsChanged event at (%d, %d) is outside the bounds of the window.", x, y))
+	}
+
+	// Pixels are ARGB8888, which is stored as B, G, R, A.
+	i := 4 * (y*int(w.Width) + x)
+	w.pixels[i+0] = blue
+	w.pixels[i+1] = green
+	w.pixels[i+2] = red
+	w.pixels[i+3] = 0xFF
+}
+
 func (w *Window) CountPixels() int {
 	count := 0
 	for i := 0; i < int(w.Width) * int(w.Height) * 4; i += 4 {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TestSparse runs the test images on the sparse engine for long enough that they spill out of
+// the viewport, and checks the final alive cells and the exported bounding box against the
+// reference run in the middle of a torus too big for anything to reach its edges.
+func TestSparse(t *testing.T) {
+	for _, size := range []int{16, 64} {
+		for _, turns := range []int{0, 1, 100} {
+			for _, threads := range []int{1, 4} {
+				p := gol.Params{ImageWidth: size, ImageHeight: size, Turns: turns, Threads: threads, Engine: gol.SparseEngine}
+				t.Run(fmt.Sprintf("%dx%dx%d-%d", size, size, turns, threads), func(t *testing.T) {
+					emptyOutFolder()
+					expected := referenceUnbounded(readAliveCells(fmt.Sprintf("images/%vx%v.pgm", size, size), size, size), turns)
+					cells := finalAliveCells(p)
+					assertEqualBoard(t, cells, expected, p)
+					checkBoundingBox(t, expected, turns)
+				})
+			}
+		}
+	}
+
+	// The 16x16 image is a glider, which moves a cell south east every four turns.
+	p := gol.Params{ImageWidth: 16, ImageHeight: 16, Turns: 400, Threads: 4, Engine: gol.SparseEngine}
+	t.Run("16x16x400", func(t *testing.T) {
+		emptyOutFolder()
+		expected := readAliveCells("images/16x16.pgm", 16, 16)
+		for i := range expected {
+			expected[i].X += 100
+			expected[i].Y += 100
+		}
+		assertEqualBoard(t, finalAliveCells(p), expected, p)
+		checkBoundingBox(t, expected, 400)
+	})
+}
+
+// referenceUnbounded runs the reference in the middle of a torus big enough that a pattern
+// growing at the speed of light can't wrap round in the given number of turns.
+func referenceUnbounded(alive []util.Cell, turns int) []util.Cell {
+	margin := turns + 1
+	size := 64 + 2*margin
+	shifted := make([]util.Cell, len(alive))
+	for i, cell := range alive {
+		shifted[i] = util.Cell{X: cell.X + margin, Y: cell.Y + margin}
+	}
+	cells := referenceAliveCells(shifted, size, size, turns)
+	for i := range cells {
+		cells[i].X -= margin
+		cells[i].Y -= margin
+	}
+	return cells
+}
+
+// checkBoundingBox reads the image saved at the end of a sparse run and checks that it is the
+// bounding box of the expected cells, at the origin given in its header.
+func checkBoundingBox(t *testing.T, expected []util.Cell, turns int) {
+	minX, minY, maxX, maxY := expected[0].X, expected[0].Y, expected[0].X, expected[0].Y
+	for _, cell := range expected {
+		if cell.X < minX {
+			minX = cell.X
+		}
+		if cell.Y < minY {
+			minY = cell.Y
+		}
+		if cell.X > maxX {
+			maxX = cell.X
+		}
+		if cell.Y > maxY {
+			maxY = cell.Y
+		}
+	}
+	width, height := maxX-minX+1, maxY-minY+1
+
+	data, err := os.ReadFile(fmt.Sprintf("out/%dx%dx%d.pgm", width, height, turns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := fmt.Sprintf("P5\n# origin %d %d\n%d %d\n255\n", minX, minY, width, height)
+	if len(data) != len(header)+width*height || string(data[:len(header)]) != header {
+		t.Fatalf("the image does not start with the header %q or is the wrong length", header)
+	}
+	var cells []util.Cell
+	for i, pixel := range data[len(header):] {
+		if pixel == 255 {
+			cells = append(cells, util.Cell{X: minX + i%width, Y: minY + i/width})
+		}
+	}
+	if !checkEqualBoard(cells, expected) {
+		t.Fatalf("the image does not match the expected cells")
+	}
+}
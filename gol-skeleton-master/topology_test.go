@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"uk.ac.bris.cs/gameoflife/gol"
+	"uk.ac.bris.cs/gameoflife/util"
+)
+
+// TestTopology runs the 16x16, 64x64 and 128x64 images for 100 turns on every topology other than the
+// torus, checking against the images in check/images/<topology>.
+func TestTopology(t *testing.T) {
+	topologies := []util.Topology{util.Plane, util.Cylinder, util.KleinBottle, util.CrossSurface}
+	sizes := [][2]int{{16, 16}, {64, 64}, {128, 64}}
+	for _, topology := range topologies {
+		for _, size := range sizes {
+			p := gol.Params{ImageWidth: size[0], ImageHeight: size[1], Turns: 100, Topology: topology}
+			expectedAlive := readAliveCells(
+				fmt.Sprintf("check/images/%v/%vx%vx%v.pgm", topology, p.ImageWidth, p.ImageHeight, p.Turns),
+				p.ImageWidth,
+				p.ImageHeight,
+			)
+			for _, threads := range []int{1, 4, 8} {
+				p.Threads = threads
+				t.Run(fmt.Sprintf("%v-%dx%dx%d-%d", topology, p.ImageWidth, p.ImageHeight, p.Turns, p.Threads), func(t *testing.T) {
+					assertEqualBoard(t, finalAliveCells(p), expectedAlive, p)
+				})
+			}
+		}
+	}
+}
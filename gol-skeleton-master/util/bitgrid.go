@@ -0,0 +1,219 @@
+package util
+
+import "math/bits"
+
+// BitGrid is a world packed one bit per cell. Each row starts on a fresh 64-bit word, with
+// cell x of a row in bit x%64 of word x/64. Bits past the width of a row are always zero.
+type BitGrid struct {
+	Width  int
+	Height int
+	Words  []uint64
+}
+
+// NewBitGrid makes an empty width x height grid.
+func NewBitGrid(width, height int) *BitGrid {
+	return &BitGrid{Width: width, Height: height, Words: make([]uint64, WordsPerRow(width)*height)}
+}
+
+// WordsPerRow returns how many words hold a row of width cells.
+func WordsPerRow(width int) int {
+	return (width + 63) / 64
+}
+
+// Get reports whether the cell at (x, y) is alive.
+func (g *BitGrid) Get(x, y int) bool {
+	return RowCell(g.Row(y), x)
+}
+
+// Set makes the cell at (x, y) alive or dead.
+func (g *BitGrid) Set(x, y int, alive bool) {
+	SetRowCell(g.Row(y), x, alive)
+}
+
+// RowCell reports whether cell x of a packed row is alive.
+func RowCell(row []uint64, x int) bool {
+	return row[x/64]&(1<<uint(x%64)) != 0
+}
+
+// SetRowCell makes cell x of a packed row alive or dead.
+func SetRowCell(row []uint64, x int, alive bool) {
+	if alive {
+		row[x/64] |= 1 << uint(x%64)
+	} else {
+		row[x/64] &^= 1 << uint(x%64)
+	}
+}
+
+// Column returns column x of the grid, packed like a row of Height cells.
+func (g *BitGrid) Column(x int) []uint64 {
+	column := make([]uint64, WordsPerRow(g.Height))
+	for y := 0; y < g.Height; y++ {
+		SetRowCell(column, y, g.Get(x, y))
+	}
+	return column
+}
+
+// Row returns the words of row y. Changes to it change the grid.
+func (g *BitGrid) Row(y int) []uint64 {
+	n := WordsPerRow(g.Width)
+	return g.Words[y*n : (y+1)*n : (y+1)*n]
+}
+
+// Rows returns a grid sharing rows startY up to endY of g.
+func (g *BitGrid) Rows(startY, endY int) *BitGrid {
+	n := WordsPerRow(g.Width)
+	return &BitGrid{Width: g.Width, Height: endY - startY, Words: g.Words[startY*n : endY*n : endY*n]}
+}
+
+// PopCount returns the number of alive cells.
+func (g *BitGrid) PopCount() int {
+	count := 0
+	for _, word := range g.Words {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// AliveCells lists the alive cells, offsetting every y by startY.
+func (g *BitGrid) AliveCells(startY int) []Cell {
+	cells := []Cell{}
+	for y := 0; y < g.Height; y++ {
+		cells = appendCells(cells, g.Row(y), startY+y)
+	}
+	return cells
+}
+
+// FlippedCells lists the cells that differ between g and next, offsetting every y by startY.
+func (g *BitGrid) FlippedCells(next *BitGrid, startY int) []Cell {
+	cells := []Cell{}
+	diff := make([]uint64, WordsPerRow(g.Width))
+	for y := 0; y < g.Height; y++ {
+		row, nextRow := g.Row(y), next.Row(y)
+		for i := range diff {
+			diff[i] = row[i] ^ nextRow[i]
+		}
+		cells = appendCells(cells, diff, startY+y)
+	}
+	return cells
+}
+
+// appendCells appends a cell for every set bit of a row.
+func appendCells(cells []Cell, row []uint64, y int) []Cell {
+	for i, word := range row {
+		for word != 0 {
+			x := i*64 + bits.TrailingZeros64(word)
+			cells = append(cells, Cell{X: x, Y: y})
+			word &= word - 1
+		}
+	}
+	return cells
+}
+
+// NextRow computes the next state of a row of width cells under the rule, from the rows above
+// and below it. The rows wrap around horizontally if wrap is set, and otherwise have dead cells
+// beyond both ends. Every cell of the row is worked out at once, 64 to a word, by adding up
+// the eight neighbour bit planes with bitwise adders.
+func (r Rule) NextRow(next, above, row, below []uint64, width int, wrap bool) {
+	n := len(row)
+	planes := [8][]uint64{above, below}
+	for i, rr := range [][]uint64{above, row, below} {
+		planes[2+2*i] = make([]uint64, n)
+		planes[3+2*i] = make([]uint64, n)
+		shiftWest(planes[2+2*i], rr, width, wrap)
+		shiftEast(planes[3+2*i], rr, width, wrap)
+	}
+
+	for i := 0; i < n; i++ {
+		next[i] = r.nextWord([8]uint64{
+			planes[0][i], planes[1][i], planes[2][i], planes[3][i],
+			planes[4][i], planes[5][i], planes[6][i], planes[7][i],
+		}, row[i])
+	}
+	if n > 0 {
+		next[n-1] &= lastWordMask(width)
+	}
+}
+
+// nextWord works out the next state of 64 cells at once from their current state and the eight
+// planes of their neighbours.
+func (r Rule) nextWord(planes [8]uint64, alive uint64) uint64 {
+	// ones, twos, fours and eights are the bits of the neighbour count of each cell.
+	var ones, twos, fours, eights uint64
+	for _, plane := range planes {
+		carry := ones & plane
+		ones ^= plane
+		carry, twos = twos&carry, twos^carry
+		carry, fours = fours&carry, fours^carry
+		eights |= carry
+	}
+
+	var born, survives uint64
+	for count := uint(0); count <= 8; count++ {
+		if (r.Birth|r.Survive)&(1<<count) == 0 {
+			continue
+		}
+		match := ^uint64(0)
+		for bit, plane := range [4]uint64{ones, twos, fours, eights} {
+			if count&(1<<uint(bit)) != 0 {
+				match &= plane
+			} else {
+				match &^= plane
+			}
+		}
+		if r.Birth&(1<<count) != 0 {
+			born |= match
+		}
+		if r.Survive&(1<<count) != 0 {
+			survives |= match
+		}
+	}
+	return born&^alive | survives&alive
+}
+
+// shiftWest sets dst to the row of western neighbours: bit x of dst is bit x-1 of src.
+func shiftWest(dst, src []uint64, width int, wrap bool) {
+	var carry uint64
+	for i, word := range src {
+		dst[i] = word<<1 | carry
+		carry = word >> 63
+	}
+	if wrap && src[(width-1)/64]&(1<<uint((width-1)%64)) != 0 {
+		dst[0] |= 1
+	}
+	dst[len(dst)-1] &= lastWordMask(width)
+}
+
+// shiftEast sets dst to the row of eastern neighbours: bit x of dst is bit x+1 of src.
+func shiftEast(dst, src []uint64, width int, wrap bool) {
+	for i := range src {
+		dst[i] = src[i] >> 1
+		if i+1 < len(src) {
+			dst[i] |= src[i+1] << 63
+		}
+	}
+	dst[len(dst)-1] &= lastWordMask(width)
+	if wrap && src[0]&1 != 0 {
+		last := width - 1
+		dst[last/64] |= 1 << uint(last%64)
+	}
+}
+
+// ReverseRow returns a new row of width cells with the cells of row in the opposite order.
+func ReverseRow(row []uint64, width int) []uint64 {
+	reversed := make([]uint64, len(row))
+	for x := 0; x < width; x++ {
+		if row[x/64]&(1<<uint(x%64)) != 0 {
+			mirrored := width - 1 - x
+			reversed[mirrored/64] |= 1 << uint(mirrored%64)
+		}
+	}
+	return reversed
+}
+
+// lastWordMask covers the bits of the last word of a row that hold cells.
+func lastWordMask(width int) uint64 {
+	if width%64 == 0 {
+		return ^uint64(0)
+	}
+	return 1<<uint(width%64) - 1
+}
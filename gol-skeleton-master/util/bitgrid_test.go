@@ -0,0 +1,118 @@
+package util
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// TestBitGrid checks that packed worlds hold the cells set in them, and that stepping them
+// word by word matches stepping them cell by cell on widths either side of a word boundary.
+func TestBitGrid(t *testing.T) {
+	for _, width := range []int{1, 3, 63, 64, 65, 130} {
+		height := 7
+		t.Run(fmt.Sprintf("%dx%d", width, height), func(t *testing.T) {
+			random := rand.New(rand.NewSource(int64(width)))
+			grid := NewBitGrid(width, height)
+			var alive []Cell
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					if random.Intn(3) == 0 {
+						grid.Set(x, y, true)
+						alive = append(alive, Cell{X: x, Y: y})
+					}
+				}
+			}
+
+			if grid.PopCount() != len(alive) {
+				t.Errorf("PopCount is %d, expected %d", grid.PopCount(), len(alive))
+			}
+			if !reflect.DeepEqual(grid.AliveCells(0), alive) {
+				t.Fatalf("the grid does not hold the cells set in it")
+			}
+
+			for turn := 1; turn <= 10; turn++ {
+				next := NewBitGrid(width, height)
+				for y := 0; y < height; y++ {
+					Life.NextRow(next.Row(y), grid.Row((y-1+height)%height), grid.Row(y), grid.Row((y+1)%height), width, true)
+				}
+				expected := referenceNext(grid, Life, Torus)
+				if !reflect.DeepEqual(next.Words, expected.Words) {
+					t.Fatalf("turn %d differs from the reference", turn)
+				}
+
+				var flipped []Cell
+				for y := 0; y < height; y++ {
+					for x := 0; x < width; x++ {
+						if grid.Get(x, y) != next.Get(x, y) {
+							flipped = append(flipped, Cell{X: x, Y: y + 10})
+						}
+					}
+				}
+				if cells := grid.FlippedCells(next, 10); len(cells) != len(flipped) || len(cells) > 0 && !reflect.DeepEqual(cells, flipped) {
+					t.Fatalf("turn %d flipped %d cells, expected %d", turn, len(cells), len(flipped))
+				}
+				grid = next
+			}
+		})
+	}
+}
+
+// TestRows checks that strips of rows and single columns read the cells of the grid.
+func TestRows(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	grid := NewBitGrid(70, 9)
+	for i := range grid.Words {
+		grid.Words[i] = random.Uint64()
+	}
+	// Bits past the end of each row are always clear.
+	for y := 0; y < grid.Height; y++ {
+		grid.Row(y)[1] &= 1<<6 - 1
+	}
+
+	rows := grid.Rows(2, 5)
+	for y := 0; y < rows.Height; y++ {
+		for x := 0; x < rows.Width; x++ {
+			if rows.Get(x, y) != grid.Get(x, y+2) {
+				t.Fatalf("(%d, %d) of rows 2 to 5 differs from the grid", x, y)
+			}
+		}
+	}
+	for _, x := range []int{0, 63, 64, 69} {
+		column := grid.Column(x)
+		for y := 0; y < grid.Height; y++ {
+			if RowCell(column, y) != grid.Get(x, y) {
+				t.Fatalf("(%d, %d) of column %d differs from the grid", x, y, x)
+			}
+		}
+	}
+	reversed := ReverseRow(grid.Row(3), grid.Width)
+	for x := 0; x < grid.Width; x++ {
+		if RowCell(reversed, x) != grid.Get(grid.Width-1-x, 3) {
+			t.Fatalf("cell %d of the reversed row differs from cell %d of the row", x, grid.Width-1-x)
+		}
+	}
+}
+
+// referenceNext steps a grid one cell at a time.
+func referenceNext(grid *BitGrid, rule Rule, topology Topology) *BitGrid {
+	next := NewBitGrid(grid.Width, grid.Height)
+	for y := 0; y < grid.Height; y++ {
+		for x := 0; x < grid.Width; x++ {
+			neighbours := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if dy == 0 && dx == 0 {
+						continue
+					}
+					if x2, y2, ok := topology.Locate(x+dx, y+dy, grid.Width, grid.Height); ok && grid.Get(x2, y2) {
+						neighbours++
+					}
+				}
+			}
+			next.Set(x, y, rule.Next(grid.Get(x, y), neighbours))
+		}
+	}
+	return next
+}
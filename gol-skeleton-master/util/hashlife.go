@@ -0,0 +1,513 @@
+package util
+
+import "fmt"
+
+// HashLife runs a world with Gosper's HashLife algorithm. The world is a quadtree whose nodes
+// are canonical, so a square that appears many times, in space or in time, is stored once, and
+// the future of each square is memoised on its node. That lets periodic patterns be jumped
+// forward 2^k turns at a time for very large k.
+//
+// The world sits in the top left corner of a quadtree whose side is the next power of two,
+// padded with dead cells. A torus is jumped forward on a window of copies of the world, a plane
+// is moved on a turn at a time with the cells that leave it cleared, and an unbounded world
+// grows the quadtree as its pattern spreads.
+type HashLife struct {
+	rule          Rule
+	topology      Topology
+	unbounded     bool
+	width, height int
+	// origin is the position of the top left cell of root, which moves as an unbounded world grows.
+	origin Cell
+	root   *node
+	nodes  map[quad]*node
+	empty  []*node
+	// blocks holds the 8x8 nodes by their cells, a byte to a row.
+	blocks map[uint64]*node
+	// tiles holds the squares of a torus window by their level and position in the world, and
+	// grid the world they are read from, while the window is being built.
+	tiles map[tileKey]*node
+	grid  *BitGrid
+}
+
+type tileKey struct {
+	level, x, y int
+}
+
+type quad struct {
+	nw, ne, sw, se *node
+}
+
+// node is a square of 1<<level cells. Level 0 nodes are single cells.
+type node struct {
+	quad
+	level      int
+	population int
+	// result is the centre of the node, half its side, after 1<<resultStep turns.
+	result     *node
+	resultStep int
+}
+
+// maxNodes is how many nodes are kept before the ones no longer in the world are thrown away.
+const maxNodes = 1 << 21
+
+// blockLevel is the level of the 8x8 nodes that worlds are built from.
+const blockLevel = 3
+
+// maxPhases is how many ways a torus may line up with its own quadtree before its jumps are
+// limited, which is the product of the odd factors of its width and height.
+const maxPhases = 1 << 10
+
+var (
+	deadCell  = &node{}
+	aliveCell = &node{population: 1}
+)
+
+// NewHashLife loads a torus or plane world into a quadtree to be run under the rule.
+func NewHashLife(world *BitGrid, rule Rule, topology Topology) (*HashLife, error) {
+	if topology != Torus && topology != Plane {
+		return nil, fmt.Errorf("hashlife runs a torus or a plane, not a %v", topology)
+	}
+	return newHashLife(world, rule, topology), nil
+}
+
+// NewUnboundedHashLife loads a world with no edges into a quadtree to be run under the rule,
+// with the top left cell of the world at (0, 0).
+func NewUnboundedHashLife(world *BitGrid, rule Rule) (*HashLife, error) {
+	if rule.Birth&1 != 0 {
+		return nil, fmt.Errorf("rules with B0 such as %v would fill an unbounded world", rule)
+	}
+	h := newHashLife(world, rule, Plane)
+	h.unbounded = true
+	return h, nil
+}
+
+func newHashLife(world *BitGrid, rule Rule, topology Topology) *HashLife {
+	h := &HashLife{
+		rule:     rule,
+		topology: topology,
+		width:    world.Width,
+		height:   world.Height,
+		nodes:    make(map[quad]*node),
+		blocks:   make(map[uint64]*node),
+	}
+	level := blockLevel
+	for 1<<uint(level) < world.Width || 1<<uint(level) < world.Height {
+		level++
+	}
+	h.root = h.build(world, 0, 0, level)
+	return h
+}
+
+// build makes the node for the square of the given level at (x, y), with dead cells past the
+// edges of the world.
+func (h *HashLife) build(world *BitGrid, x, y, level int) *node {
+	if x >= world.Width || y >= world.Height {
+		return h.emptyNode(level)
+	}
+	if level == blockLevel {
+		var bits uint64
+		for r := 0; r < 8 && y+r < world.Height; r++ {
+			bits |= rowBits(world.Row(y+r), x) << uint(8*r)
+		}
+		return h.block(bits)
+	}
+	half := 1 << uint(level-1)
+	return h.join(
+		h.build(world, x, y, level-1), h.build(world, x+half, y, level-1),
+		h.build(world, x, y+half, level-1), h.build(world, x+half, y+half, level-1))
+}
+
+// rowBits returns the 8 cells of a packed row from x, which must be at least 8 cells from the
+// end of its last word.
+func rowBits(row []uint64, x int) uint64 {
+	w, s := x/64, uint(x%64)
+	bits := row[w] >> s
+	if s > 56 {
+		bits |= row[w+1] << (64 - s)
+	}
+	return bits & 0xff
+}
+
+// block returns the 8x8 node with the given cells.
+func (h *HashLife) block(bits uint64) *node {
+	if n, ok := h.blocks[bits]; ok {
+		return n
+	}
+	n := h.fromBits(bits, 0, 0, blockLevel)
+	h.blocks[bits] = n
+	return n
+}
+
+func (h *HashLife) fromBits(bits uint64, x, y, level int) *node {
+	if level == 0 {
+		if bits&(1<<uint(8*y+x)) != 0 {
+			return aliveCell
+		}
+		return deadCell
+	}
+	half := 1 << uint(level-1)
+	return h.join(
+		h.fromBits(bits, x, y, level-1), h.fromBits(bits, x+half, y, level-1),
+		h.fromBits(bits, x, y+half, level-1), h.fromBits(bits, x+half, y+half, level-1))
+}
+
+// join returns the canonical node made of four nodes one level down.
+func (h *HashLife) join(nw, ne, sw, se *node) *node {
+	q := quad{nw, ne, sw, se}
+	if n, ok := h.nodes[q]; ok {
+		return n
+	}
+	n := &node{quad: q, level: nw.level + 1, resultStep: -1}
+	// Populations are only read on squares the size of the world, so saturating is enough
+	// for the huge windows built to take long jumps.
+	for _, child := range []*node{nw, ne, sw, se} {
+		n.population += child.population
+		if n.population < 0 || n.population > 1<<60 {
+			n.population = 1 << 60
+		}
+	}
+	h.nodes[q] = n
+	return n
+}
+
+// emptyNode returns the node of the given level with no alive cells.
+func (h *HashLife) emptyNode(level int) *node {
+	for len(h.empty) <= level {
+		if len(h.empty) == 0 {
+			h.empty = append(h.empty, deadCell)
+			continue
+		}
+		e := h.empty[len(h.empty)-1]
+		h.empty = append(h.empty, h.join(e, e, e, e))
+	}
+	return h.empty[level]
+}
+
+// centre returns the middle of a node, half its side, without moving it on in time.
+func (h *HashLife) centre(n *node) *node {
+	return h.join(n.nw.se, n.ne.sw, n.sw.ne, n.se.nw)
+}
+
+// advance returns the centre of a node of level 2 or more after 1<<step turns, or after
+// 1<<(level-2) turns if that is fewer, which is as far as the node can see.
+func (h *HashLife) advance(n *node, step int) *node {
+	if step > n.level-2 {
+		step = n.level - 2
+	}
+	if n.result != nil && n.resultStep == step {
+		return n.result
+	}
+
+	var result *node
+	switch {
+	case n.population == 0 && h.rule.Birth&1 == 0:
+		result = h.emptyNode(n.level - 1)
+	case n.level == 2:
+		result = h.base(n)
+	default:
+		// The nine overlapping squares one level down, each half the side of n.
+		n00, n01, n02 := n.nw, h.join(n.nw.ne, n.ne.nw, n.nw.se, n.ne.sw), n.ne
+		n10 := h.join(n.nw.sw, n.nw.se, n.sw.nw, n.sw.ne)
+		n11 := h.join(n.nw.se, n.ne.sw, n.sw.ne, n.se.nw)
+		n12 := h.join(n.ne.sw, n.ne.se, n.se.nw, n.se.ne)
+		n20, n21, n22 := n.sw, h.join(n.sw.ne, n.se.nw, n.sw.se, n.se.sw), n.se
+
+		// At full speed each square is moved on half the way here and the rest below;
+		// otherwise the squares are only trimmed here and moved on below.
+		squares := [9]*node{n00, n01, n02, n10, n11, n12, n20, n21, n22}
+		for i, square := range squares {
+			if step == n.level-2 {
+				squares[i] = h.advance(square, step)
+			} else {
+				squares[i] = h.centre(square)
+			}
+		}
+		result = h.join(
+			h.advance(h.join(squares[0], squares[1], squares[3], squares[4]), step),
+			h.advance(h.join(squares[1], squares[2], squares[4], squares[5]), step),
+			h.advance(h.join(squares[3], squares[4], squares[6], squares[7]), step),
+			h.advance(h.join(squares[4], squares[5], squares[7], squares[8]), step))
+	}
+	n.result, n.resultStep = result, step
+	return result
+}
+
+// base works out the middle 2x2 cells of a 4x4 node one turn on under the rule.
+func (h *HashLife) base(n *node) *node {
+	var cells [4][4]bool
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			cells[y][x] = subnode(n, x, y, 0) == aliveCell
+		}
+	}
+	next := func(x, y int) *node {
+		neighbours := 0
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				if (dx != 0 || dy != 0) && cells[y+dy][x+dx] {
+					neighbours++
+				}
+			}
+		}
+		if h.rule.Next(cells[y][x], neighbours) {
+			return aliveCell
+		}
+		return deadCell
+	}
+	return h.join(next(1, 1), next(2, 1), next(1, 2), next(2, 2))
+}
+
+// subnode returns the node of the given level at (x, y) within n.
+func subnode(n *node, x, y, level int) *node {
+	for n.level > level {
+		half := 1 << uint(n.level-1)
+		switch {
+		case x < half && y < half:
+			n = n.nw
+		case y < half:
+			n, x = n.ne, x-half
+		case x < half:
+			n, y = n.sw, y-half
+		default:
+			n, x, y = n.se, x-half, y-half
+		}
+	}
+	return n
+}
+
+// MaxStep returns the largest k that Step takes. A torus with large odd factors in its width
+// and height lines up with its quadtree in too many ways to build huge windows onto, so its
+// jumps are kept to the side of its quadtree.
+func (h *HashLife) MaxStep() int {
+	switch {
+	case h.unbounded:
+		return 60
+	case h.topology == Torus && oddPart(h.width)*oddPart(h.height) > maxPhases:
+		return h.root.level
+	}
+	return 62
+}
+
+func oddPart(n int) int {
+	for n%2 == 0 {
+		n /= 2
+	}
+	return n
+}
+
+// Step moves the world on 1<<k turns and returns the cells that flipped. k is cut down to
+// MaxStep if it is larger.
+func (h *HashLife) Step(k int) []Cell {
+	if k > h.MaxStep() {
+		k = h.MaxStep()
+	}
+	before := h.root
+	switch {
+	case h.unbounded:
+		h.grow(k)
+		// The root is moved on from its centre, so the world before is compared from there.
+		before = h.centre(h.root)
+		quarter := 1 << uint(h.root.level-2)
+		h.root = h.advance(h.root, k)
+		h.origin = Cell{X: h.origin.X + quarter, Y: h.origin.Y + quarter}
+	case h.topology == Plane:
+		for turn := 0; turn < 1<<uint(k); turn++ {
+			h.root = h.planeTurn()
+			if len(h.nodes) > maxNodes {
+				h.collect()
+			}
+		}
+	default:
+		h.root = h.jump(k)
+	}
+
+	cells := []Cell{}
+	h.appendFlipped(&cells, before, h.root, h.origin.X, h.origin.Y)
+	if len(h.nodes) > maxNodes {
+		h.collect()
+	}
+	return cells
+}
+
+// jump moves a torus on 1<<k turns. A window onto the plane tiled with copies of the world is
+// built with its centre starting at the world's top left cell, so once the centre is at least
+// as big as the world, the top left of the centre moved on is the world moved on.
+func (h *HashLife) jump(k int) *node {
+	level := h.root.level + 1
+	if k+2 > level {
+		level = k + 2
+	}
+	quarter := 1 << uint(level-2)
+	h.tiles = make(map[tileKey]*node)
+	window := h.tile(-quarter, -quarter, level)
+	h.tiles, h.grid = nil, nil
+
+	next := h.advance(window, k)
+	for next.level > h.root.level {
+		next = next.nw
+	}
+	return h.clip(next, 0, 0)
+}
+
+// tile returns the node for the square of the given level at (x, y) on the plane tiled with
+// copies of the world. Squares that line up with the quadtree of the world are taken from it,
+// and the rest are joined up from 8x8 blocks read from the packed world.
+func (h *HashLife) tile(x, y, level int) *node {
+	x, y = wrap(x, h.width), wrap(y, h.height)
+	side := 1 << uint(level)
+	if x%side == 0 && y%side == 0 && x+side <= h.width && y+side <= h.height {
+		return subnode(h.root, x, y, level)
+	}
+	if level == blockLevel {
+		if h.grid == nil {
+			h.grid = h.Grid()
+		}
+		var bits uint64
+		for r := 0; r < 8; r++ {
+			row := h.grid.Row((y + r) % h.height)
+			var rowByte uint64
+			if x+8 <= h.width {
+				rowByte = rowBits(row, x)
+			} else {
+				for c := 0; c < 8; c++ {
+					if RowCell(row, (x+c)%h.width) {
+						rowByte |= 1 << uint(c)
+					}
+				}
+			}
+			bits |= rowByte << uint(8*r)
+		}
+		return h.block(bits)
+	}
+
+	key := tileKey{level, x, y}
+	if n, ok := h.tiles[key]; ok {
+		return n
+	}
+	half := side / 2
+	n := h.join(
+		h.tile(x, y, level-1), h.tile(x+half, y, level-1),
+		h.tile(x, y+half, level-1), h.tile(x+half, y+half, level-1))
+	h.tiles[key] = n
+	return n
+}
+
+// planeTurn moves a plane on one turn. The root is set in a window four times its side, with
+// dead cells all round, so that the centre of the window one turn on starts at the world's
+// top left cell.
+func (h *HashLife) planeTurn() *node {
+	e, outside := h.emptyNode(h.root.level), h.emptyNode(h.root.level+1)
+	next := h.advance(h.join(h.join(e, e, e, h.root), outside, outside, outside), 0)
+	return h.clip(next.nw, 0, 0)
+}
+
+// clip clears the cells of n, whose top left cell is at (x, y), that lie past the edges of
+// the world.
+func (h *HashLife) clip(n *node, x, y int) *node {
+	side := 1 << uint(n.level)
+	switch {
+	case n.population == 0 || x+side <= h.width && y+side <= h.height:
+		return n
+	case x >= h.width || y >= h.height:
+		return h.emptyNode(n.level)
+	}
+	half := side / 2
+	return h.join(
+		h.clip(n.nw, x, y), h.clip(n.ne, x+half, y),
+		h.clip(n.sw, x, y+half), h.clip(n.se, x+half, y+half))
+}
+
+// grow pads an unbounded world with dead cells until its pattern sits in the middle of the
+// middle of the root, far enough from the edges to be moved on 1<<k turns.
+func (h *HashLife) grow(k int) {
+	for h.root.level < k+3 || h.centre(h.centre(h.root)).population != h.root.population {
+		r, e := h.root, h.emptyNode(h.root.level-1)
+		h.root = h.join(
+			h.join(e, e, e, r.nw), h.join(e, e, r.ne, e),
+			h.join(e, r.sw, e, e), h.join(r.se, e, e, e))
+		half := 1 << uint(r.level-1)
+		h.origin = Cell{X: h.origin.X - half, Y: h.origin.Y - half}
+	}
+}
+
+// appendFlipped appends the cells that differ between a and b, whose top left cells are at
+// (x, y), skipping the squares they share.
+func (h *HashLife) appendFlipped(cells *[]Cell, a, b *node, x, y int) {
+	if a == b {
+		return
+	}
+	if a.level == 0 {
+		*cells = append(*cells, Cell{X: x, Y: y})
+		return
+	}
+	half := 1 << uint(a.level-1)
+	h.appendFlipped(cells, a.nw, b.nw, x, y)
+	h.appendFlipped(cells, a.ne, b.ne, x+half, y)
+	h.appendFlipped(cells, a.sw, b.sw, x, y+half)
+	h.appendFlipped(cells, a.se, b.se, x+half, y+half)
+}
+
+// collect throws away every node that isn't part of the current world, along with all memoised
+// results, which may point at them.
+func (h *HashLife) collect() {
+	h.nodes = make(map[quad]*node)
+	var keep func(n *node)
+	keep = func(n *node) {
+		if n.level == 0 {
+			return
+		}
+		n.result, n.resultStep = nil, -1
+		if _, ok := h.nodes[n.quad]; ok {
+			return
+		}
+		h.nodes[n.quad] = n
+		keep(n.nw)
+		keep(n.ne)
+		keep(n.sw)
+		keep(n.se)
+	}
+	h.blocks = make(map[uint64]*node)
+	keep(h.root)
+	for _, e := range h.empty {
+		keep(e)
+	}
+}
+
+// PopCount returns the number of alive cells in the world.
+func (h *HashLife) PopCount() int {
+	return h.root.population
+}
+
+// AliveCells lists the alive cells of the world.
+func (h *HashLife) AliveCells() []Cell {
+	cells := []Cell{}
+	h.appendAlive(&cells, h.root, h.origin.X, h.origin.Y)
+	return cells
+}
+
+func (h *HashLife) appendAlive(cells *[]Cell, n *node, x, y int) {
+	if n.population == 0 {
+		return
+	}
+	if n.level == 0 {
+		*cells = append(*cells, Cell{X: x, Y: y})
+		return
+	}
+	half := 1 << uint(n.level-1)
+	h.appendAlive(cells, n.nw, x, y)
+	h.appendAlive(cells, n.ne, x+half, y)
+	h.appendAlive(cells, n.sw, x, y+half)
+	h.appendAlive(cells, n.se, x+half, y+half)
+}
+
+// Grid returns the world packed into a BitGrid. An unbounded world is cut down to the width
+// and height it started with.
+func (h *HashLife) Grid() *BitGrid {
+	world := NewBitGrid(h.width, h.height)
+	for _, cell := range h.AliveCells() {
+		if cell.X >= 0 && cell.Y >= 0 && cell.X < h.width && cell.Y < h.height {
+			world.Set(cell.X, cell.Y, true)
+		}
+	}
+	return world
+}
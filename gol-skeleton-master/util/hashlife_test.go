@@ -0,0 +1,169 @@
+package util
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestHashLifeSizes steps random worlds whose sides aren't powers of two on a torus and a plane
+// in jumps of different lengths, and checks every jump against the reference.
+func TestHashLifeSizes(t *testing.T) {
+	sizes := [][2]int{{5, 7}, {24, 40}, {100, 30}, {130, 66}, {99, 101}}
+	for _, topology := range []Topology{Torus, Plane} {
+		for i, size := range sizes {
+			width, height := size[0], size[1]
+			t.Run(fmt.Sprintf("%v-%dx%d", topology, width, height), func(t *testing.T) {
+				world := randomBitGrid(width, height, int64(i))
+				for _, rule := range []Rule{Life, mustParseRule(t, "B0123478/S34678")} {
+					life, err := NewHashLife(world, rule, topology)
+					if err != nil {
+						t.Fatal(err)
+					}
+					expected, turn := world, 0
+					for _, k := range []int{0, 0, 1, 3, 2, 5, 0, 4} {
+						before := expected
+						for i := 0; i < 1<<uint(k); i++ {
+							expected = referenceNext(expected, rule, topology)
+						}
+						turn += 1 << uint(k)
+						flipped := life.Step(k)
+						if !reflect.DeepEqual(life.Grid().Words, expected.Words) {
+							t.Fatalf("turn %d under %v differs from the reference", turn, rule)
+						}
+						if life.PopCount() != expected.PopCount() {
+							t.Fatalf("turn %d under %v has a PopCount of %d, expected %d", turn, rule, life.PopCount(), expected.PopCount())
+						}
+						if len(flipped) != len(before.FlippedCells(expected, 0)) {
+							t.Fatalf("turn %d under %v flipped %d cells, expected %d", turn, rule, len(flipped), len(before.FlippedCells(expected, 0)))
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestHashLifeLargeTorus sends a glider across the wrap of a 5120x5120 torus in long jumps, and
+// steps a random patch across the corners of the torus against the packed grid.
+func TestHashLifeLargeTorus(t *testing.T) {
+	size := 5120
+	world := NewBitGrid(size, size)
+	start := Cell{X: size - 2, Y: size - 2}
+	for _, cell := range glider(start) {
+		world.Set(cell.X%size, cell.Y%size, true)
+	}
+	life, err := NewHashLife(world, Life, Torus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turn := 0
+	for _, k := range []int{2, 10, 14, 40, 0, 1, 0} {
+		life.Step(k)
+		turn += 1 << uint(k)
+		if life.PopCount() != 5 {
+			t.Fatalf("turn %d has a PopCount of %d, expected 5", turn, life.PopCount())
+		}
+		if turn%4 != 0 {
+			continue
+		}
+		shift := turn / 4 % size
+		var expected []Cell
+		for _, cell := range glider(Cell{X: start.X + shift, Y: start.Y + shift}) {
+			expected = append(expected, Cell{X: cell.X % size, Y: cell.Y % size})
+		}
+		assertSameCells(t, life.AliveCells(), expected, turn)
+	}
+
+	world = NewBitGrid(size, size)
+	patch := randomBitGrid(200, 200, 1)
+	for y := 0; y < patch.Height; y++ {
+		for x := 0; x < patch.Width; x++ {
+			world.Set((x+size-100)%size, (y+size-100)%size, patch.Get(x, y))
+		}
+	}
+	life, err = NewHashLife(world, Life, Torus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []int{0, 1, 3, 5} {
+		for i := 0; i < 1<<uint(k); i++ {
+			next := NewBitGrid(size, size)
+			Torus.NextRows(Life, next, world, 0, size)
+			world = next
+		}
+		life.Step(k)
+		if !reflect.DeepEqual(life.Grid().Words, world.Words) {
+			t.Fatalf("the random world differs from the packed grid after a jump of %d turns", 1<<uint(k))
+		}
+	}
+}
+
+// TestHashLifeUnbounded sends a glider off towards the south east of an unbounded world in
+// jumps of up to 2^40 turns, and checks it arrives where it should.
+func TestHashLifeUnbounded(t *testing.T) {
+	world := NewBitGrid(3, 3)
+	for _, cell := range glider(Cell{}) {
+		world.Set(cell.X, cell.Y, true)
+	}
+	life, err := NewUnboundedHashLife(world, Life)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turn := 0
+	for _, k := range []int{0, 2, 5, 20, 40, 3} {
+		life.Step(k)
+		turn += 1 << uint(k)
+		if turn%4 == 0 {
+			assertSameCells(t, life.AliveCells(), glider(Cell{X: turn / 4, Y: turn / 4}), turn)
+		}
+		if life.PopCount() != 5 {
+			t.Fatalf("turn %d has a PopCount of %d, expected 5", turn, life.PopCount())
+		}
+	}
+	if _, err := NewUnboundedHashLife(world, mustParseRule(t, "B0/S8")); err == nil {
+		t.Errorf("a B0 rule was run on an unbounded world")
+	}
+}
+
+// glider returns the cells of a glider heading south east with its bounding box at origin.
+func glider(origin Cell) []Cell {
+	var cells []Cell
+	for _, cell := range []Cell{{X: 1, Y: 0}, {X: 2, Y: 1}, {X: 0, Y: 2}, {X: 1, Y: 2}, {X: 2, Y: 2}} {
+		cells = append(cells, Cell{X: origin.X + cell.X, Y: origin.Y + cell.Y})
+	}
+	return cells
+}
+
+func assertSameCells(t *testing.T, cells, expected []Cell, turn int) {
+	t.Helper()
+	for _, list := range [][]Cell{cells, expected} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Y < list[j].Y || list[i].Y == list[j].Y && list[i].X < list[j].X
+		})
+	}
+	if !reflect.DeepEqual(cells, expected) {
+		t.Fatalf("turn %d has the cells %v, expected %v", turn, cells, expected)
+	}
+}
+
+func mustParseRule(t *testing.T, s string) Rule {
+	rule, err := ParseRule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func randomBitGrid(width, height int, seed int64) *BitGrid {
+	random := rand.New(rand.NewSource(seed))
+	world := NewBitGrid(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			world.Set(x, y, random.Intn(3) == 0)
+		}
+	}
+	return world
+}
@@ -0,0 +1,185 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rule is a life-like or Generations rule. Bit n of Birth is set if a dead cell with n alive
+// neighbours comes alive, and bit n of Survive if an alive cell with n alive neighbours stays
+// alive. Under a Generations rule, a cell that doesn't survive goes through the dying states 2
+// up to States-1 before it is dead, and only alive cells count as neighbours.
+type Rule struct {
+	Birth   uint16
+	Survive uint16
+	States  int // 0 for a life-like rule
+}
+
+// Life is Conway's Game of Life, B3/S23.
+var Life = Rule{Birth: 1 << 3, Survive: 1<<2 | 1<<3}
+
+// ParseRule reads a rule in B/S notation, such as B3/S23 for Life, B36/S23 for HighLife or
+// B2/S for Seeds, or a Generations rule in B/S/C notation, such as B2/S/C3 for Brian's Brain.
+// The older S/B and S/B/C notations, such as 23/3 and 345/2/4, are read too.
+func ParseRule(s string) (Rule, error) {
+	parts := strings.Split(strings.ToUpper(strings.TrimSpace(s)), "/")
+	if len(parts) != 2 && len(parts) != 3 {
+		return Rule{}, fmt.Errorf("rule %q is not of the form B3/S23 or B2/S/C3", s)
+	}
+
+	lettered := 0
+	for _, part := range parts {
+		if part != "" && strings.ContainsRune("BSCG", rune(part[0])) {
+			lettered++
+		}
+	}
+
+	var rule Rule
+	var err error
+	switch lettered {
+	case 0:
+		rule.Survive, err = parseCounts(parts[0])
+		if err == nil {
+			rule.Birth, err = parseCounts(parts[1])
+		}
+		if err == nil && len(parts) == 3 {
+			rule.States, err = parseStates(parts[2])
+		}
+	case len(parts):
+		seen := make(map[byte]bool)
+		for _, part := range parts {
+			letter := part[0]
+			if letter == 'G' {
+				letter = 'C'
+			}
+			if seen[letter] {
+				err = fmt.Errorf("%c is given twice", letter)
+				break
+			}
+			seen[letter] = true
+			switch letter {
+			case 'B':
+				rule.Birth, err = parseCounts(part[1:])
+			case 'S':
+				rule.Survive, err = parseCounts(part[1:])
+			case 'C':
+				rule.States, err = parseStates(part[1:])
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil && (!seen['B'] || !seen['S']) {
+			err = fmt.Errorf("both B and S are needed")
+		}
+	default:
+		err = fmt.Errorf("either every part or no part should start with B, S or C")
+	}
+	if err != nil {
+		return Rule{}, fmt.Errorf("rule %q: %v", s, err)
+	}
+	return rule, nil
+}
+
+// parseStates reads the number of states of a Generations rule.
+func parseStates(s string) (int, error) {
+	states, err := strconv.Atoi(s)
+	if err != nil || states < 2 || states > 256 {
+		return 0, fmt.Errorf("%q is not a number of states from 2 to 256", s)
+	}
+	if states == 2 {
+		// Two states is a life-like rule.
+		return 0, nil
+	}
+	return states, nil
+}
+
+// Generations reports whether the rule has dying states.
+func (r Rule) Generations() bool {
+	return r.States > 2
+}
+
+// parseCounts reads a list of neighbour counts such as 23 into a bit set.
+func parseCounts(s string) (uint16, error) {
+	var counts uint16
+	for _, c := range s {
+		if c < '0' || c > '8' {
+			return 0, fmt.Errorf("%q is not a neighbour count from 0 to 8", c)
+		}
+		counts |= 1 << uint(c-'0')
+	}
+	return counts, nil
+}
+
+// String writes the rule in B/S notation.
+func (r Rule) String() string {
+	var b strings.Builder
+	b.WriteString("B")
+	writeCounts(&b, r.Birth)
+	b.WriteString("/S")
+	writeCounts(&b, r.Survive)
+	if r.Generations() {
+		fmt.Fprintf(&b, "/C%d", r.States)
+	}
+	return b.String()
+}
+
+func writeCounts(b *strings.Builder, counts uint16) {
+	for n := 0; n <= 8; n++ {
+		if counts&(1<<uint(n)) != 0 {
+			b.WriteByte(byte('0' + n))
+		}
+	}
+}
+
+// Set parses a rule in B/S notation into r, so a Rule can be given as a command line flag.
+func (r *Rule) Set(s string) error {
+	rule, err := ParseRule(s)
+	if err != nil {
+		return err
+	}
+	*r = rule
+	return nil
+}
+
+// Next reports whether a cell is alive next turn, given whether it is alive now and how many
+// of its neighbours are.
+func (r Rule) Next(alive bool, neighbours int) bool {
+	if alive {
+		return r.Survive&(1<<uint(neighbours)) != 0
+	}
+	return r.Birth&(1<<uint(neighbours)) != 0
+}
+
+// Pixel returns the grey level a state is drawn with in a PGM image: black when dead, white
+// when alive, and fading from white to black through the dying states.
+func (r Rule) Pixel(state uint8) uint8 {
+	switch {
+	case state == 0:
+		return 0
+	case state == 1 || !r.Generations():
+		return 255
+	default:
+		return uint8(255 - 255*(int(state)-1)/(r.States-1))
+	}
+}
+
+// State returns the state drawn with the grey level pixel. Other grey levels are taken as the
+// next darker state.
+func (r Rule) State(pixel uint8) uint8 {
+	if !r.Generations() {
+		if pixel == 255 {
+			return 1
+		}
+		return 0
+	}
+	if pixel == 0 {
+		return 0
+	}
+	state := 1 + ((255-int(pixel))*(r.States-1)+254)/255
+	if state > r.States-1 {
+		state = r.States - 1
+	}
+	return uint8(state)
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// TestParseRule checks B/S, S/B and Generations notation, and that bad rules are refused.
+func TestParseRule(t *testing.T) {
+	tests := map[string]string{
+		"B3/S23":       "B3/S23",
+		"b36/s23":      "B36/S23",
+		"B2/S":         "B2/S",
+		"S34678/B3678": "B3678/S34678",
+		"23/3":         "B3/S23",
+		" B0/S8 ":      "B0/S8",
+		"B12345678/S0": "B12345678/S0",
+		"B2/S/C3":      "B2/S/C3",
+		"345/2/4":      "B2/S345/C4",
+		"/2/3":         "B2/S/C3",
+		"B3/S23/C2":    "B3/S23",
+		"g4/b2/s":      "B2/S/C4",
+	}
+	for in, expected := range tests {
+		rule, err := ParseRule(in)
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+		} else if rule.String() != expected {
+			t.Errorf("%q was read as %v, expected %v", in, rule, expected)
+		}
+	}
+	for _, in := range []string{"", "B3", "B9/S23", "B3/S2x", "B3/23", "B3/S23/S2", "B3/S23/C1", "B3/S23/C300", "B3/C3/C4"} {
+		if _, err := ParseRule(in); err == nil {
+			t.Errorf("%q was accepted", in)
+		}
+	}
+}
+
+// TestRuleNextRow steps random worlds under other rules word by word, and checks them against
+// stepping them cell by cell.
+func TestRuleNextRow(t *testing.T) {
+	for _, name := range []string{"B36/S23", "B2/S", "B3678/S34678", "B0123478/S01234678", "B012345678/S012345678"} {
+		rule, err := ParseRule(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, width := range []int{5, 64, 100} {
+			t.Run(fmt.Sprintf("%v-%d", name, width), func(t *testing.T) {
+				random := rand.New(rand.NewSource(int64(width)))
+				grid := NewBitGrid(width, 9)
+				for y := 0; y < grid.Height; y++ {
+					for x := 0; x < width; x++ {
+						grid.Set(x, y, random.Intn(3) == 0)
+					}
+				}
+				for turn := 1; turn <= 5; turn++ {
+					next := NewBitGrid(width, grid.Height)
+					for y := 0; y < grid.Height; y++ {
+						rule.NextRow(next.Row(y), grid.Row((y-1+grid.Height)%grid.Height), grid.Row(y), grid.Row((y+1)%grid.Height), width, true)
+					}
+					if !reflect.DeepEqual(next.Words, referenceNext(grid, rule, Torus).Words) {
+						t.Fatalf("turn %d differs from the reference", turn)
+					}
+					grid = next
+				}
+			})
+		}
+	}
+}
+
+// TestPixel checks that every state of a rule is drawn with a grey level that reads back as
+// the same state.
+func TestPixel(t *testing.T) {
+	for _, name := range []string{"B3/S23", "B2/S/C3", "B2/S345/C4", "B3/S23/C255"} {
+		rule, err := ParseRule(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := rule.States
+		if !rule.Generations() {
+			states = 2
+		}
+		for state := 0; state < states; state++ {
+			if got := rule.State(rule.Pixel(uint8(state))); got != uint8(state) {
+				t.Errorf("state %d of %v is drawn as %d, which reads back as state %d", state, rule, rule.Pixel(uint8(state)), got)
+			}
+		}
+	}
+}
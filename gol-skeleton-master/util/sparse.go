@@ -0,0 +1,263 @@
+package util
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// SparseWorld is an unbounded world. It is stored as 64x64 tiles, keeping only the tiles that
+// have alive cells, so a pattern can spread as far as it likes in any direction.
+type SparseWorld struct {
+	tiles map[tilePos]*tile
+}
+
+// tilePos is the position of a tile, counted in tiles from the tile holding (0, 0).
+type tilePos struct {
+	x, y int
+}
+
+// tile holds 64 rows of 64 cells, with cell x of a row in bit x.
+type tile [64]uint64
+
+var emptyTile tile
+
+// NewSparseWorld makes a world with no alive cells.
+func NewSparseWorld() *SparseWorld {
+	return &SparseWorld{tiles: make(map[tilePos]*tile)}
+}
+
+// SparseWorldFromGrid copies a grid into a sparse world, with its top left cell at (x, y).
+func SparseWorldFromGrid(g *BitGrid, x, y int) *SparseWorld {
+	w := NewSparseWorld()
+	for _, cell := range g.AliveCells(0) {
+		w.Set(x+cell.X, y+cell.Y, true)
+	}
+	return w
+}
+
+// tileOf returns the tile holding (x, y), with the column and row of the cell within it.
+// Shifting floors negative coordinates, so tiles line up across zero.
+func tileOf(x, y int) (tilePos, int, int) {
+	return tilePos{x >> 6, y >> 6}, x & 63, y & 63
+}
+
+// Get reports whether the cell at (x, y) is alive.
+func (w *SparseWorld) Get(x, y int) bool {
+	pos, col, row := tileOf(x, y)
+	t, ok := w.tiles[pos]
+	return ok && t[row]&(1<<uint(col)) != 0
+}
+
+// Set makes the cell at (x, y) alive or dead.
+func (w *SparseWorld) Set(x, y int, alive bool) {
+	pos, col, row := tileOf(x, y)
+	t, ok := w.tiles[pos]
+	if !ok {
+		if !alive {
+			return
+		}
+		t = new(tile)
+		w.tiles[pos] = t
+	}
+	if alive {
+		t[row] |= 1 << uint(col)
+	} else {
+		t[row] &^= 1 << uint(col)
+		if *t == emptyTile {
+			delete(w.tiles, pos)
+		}
+	}
+}
+
+// PopCount returns the number of alive cells.
+func (w *SparseWorld) PopCount() int {
+	count := 0
+	for _, t := range w.tiles {
+		for _, row := range t {
+			count += bits.OnesCount64(row)
+		}
+	}
+	return count
+}
+
+// AliveCells lists the alive cells.
+func (w *SparseWorld) AliveCells() []Cell {
+	cells := []Cell{}
+	for pos, t := range w.tiles {
+		cells = appendTileCells(cells, pos, t)
+	}
+	return cells
+}
+
+// appendTileCells appends a cell for every set bit of a tile.
+func appendTileCells(cells []Cell, pos tilePos, t *tile) []Cell {
+	for row, word := range t {
+		for word != 0 {
+			col := bits.TrailingZeros64(word)
+			cells = append(cells, Cell{X: pos.x<<6 + col, Y: pos.y<<6 + row})
+			word &= word - 1
+		}
+	}
+	return cells
+}
+
+// Bounds returns the top left cell and the size of the smallest rectangle holding every alive
+// cell. It reports false if no cell is alive.
+func (w *SparseWorld) Bounds() (Cell, int, int, bool) {
+	first := true
+	var minX, minY, maxX, maxY int
+	for pos, t := range w.tiles {
+		for row, word := range t {
+			if word == 0 {
+				continue
+			}
+			y := pos.y<<6 + row
+			left := pos.x<<6 + bits.TrailingZeros64(word)
+			right := pos.x<<6 + 63 - bits.LeadingZeros64(word)
+			if first {
+				minX, minY, maxX, maxY = left, y, right, y
+				first = false
+				continue
+			}
+			if left < minX {
+				minX = left
+			}
+			if right > maxX {
+				maxX = right
+			}
+			if y < minY {
+				minY = y
+			}
+			if y > maxY {
+				maxY = y
+			}
+		}
+	}
+	if first {
+		return Cell{}, 0, 0, false
+	}
+	return Cell{X: minX, Y: minY}, maxX - minX + 1, maxY - minY + 1, true
+}
+
+// Grid copies the width x height rectangle with its top left cell at (x, y) into a grid.
+func (w *SparseWorld) Grid(x, y, width, height int) *BitGrid {
+	g := NewBitGrid(width, height)
+	for pos, t := range w.tiles {
+		// Skip tiles that miss the rectangle altogether.
+		if pos.x<<6+63 < x || pos.x<<6 >= x+width || pos.y<<6+63 < y || pos.y<<6 >= y+height {
+			continue
+		}
+		for _, cell := range appendTileCells(nil, pos, t) {
+			if cell.X >= x && cell.X < x+width && cell.Y >= y && cell.Y < y+height {
+				g.Set(cell.X-x, cell.Y-y, true)
+			}
+		}
+	}
+	return g
+}
+
+// Next computes the next turn of the world under the rule, splitting the tiles between threads
+// goroutines. The rule must not bring cells with no alive neighbours to life, or the world
+// would fill up without end. It returns the new world and the cells that flipped.
+func (w *SparseWorld) Next(rule Rule, threads int) (*SparseWorld, []Cell) {
+	// Only tiles with alive cells, and the tiles next to them, can have alive cells next turn.
+	candidates := make(map[tilePos]bool)
+	for pos := range w.tiles {
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				candidates[tilePos{pos.x + dx, pos.y + dy}] = true
+			}
+		}
+	}
+	positions := make([]tilePos, 0, len(candidates))
+	for pos := range candidates {
+		positions = append(positions, pos)
+	}
+
+	if threads > len(positions) {
+		threads = len(positions)
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	nextTiles := make([]*tile, len(positions))
+	flipped := make([][]Cell, threads)
+
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(t, start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				pos := positions[i]
+				next := w.nextTile(rule, pos)
+				old := w.tile(pos)
+				var diff tile
+				for row := range diff {
+					diff[row] = old[row] ^ next[row]
+				}
+				flipped[t] = appendTileCells(flipped[t], pos, &diff)
+				if *next != emptyTile {
+					nextTiles[i] = next
+				}
+			}
+		}(t, t*len(positions)/threads, (t+1)*len(positions)/threads)
+	}
+	wg.Wait()
+
+	nextWorld := NewSparseWorld()
+	for i, next := range nextTiles {
+		if next != nil {
+			nextWorld.tiles[positions[i]] = next
+		}
+	}
+	cells := []Cell{}
+	for t := range flipped {
+		cells = append(cells, flipped[t]...)
+	}
+	return nextWorld, cells
+}
+
+// tile returns the tile at pos, which is empty if the world doesn't hold it.
+func (w *SparseWorld) tile(pos tilePos) *tile {
+	if t, ok := w.tiles[pos]; ok {
+		return t
+	}
+	return &emptyTile
+}
+
+// nextTile works out the next turn of the tile at pos, a row of 64 cells at a time.
+func (w *SparseWorld) nextTile(rule Rule, pos tilePos) *tile {
+	var around [3][3]*tile
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			around[dy+1][dx+1] = w.tile(tilePos{pos.x + dx, pos.y + dy})
+		}
+	}
+	// word returns the words of row r, which may be in the tile above or below, and of the
+	// same row in the tiles to the west and east.
+	word := func(r int) (uint64, uint64, uint64) {
+		ty := 1
+		if r < 0 {
+			ty, r = 0, 63
+		} else if r > 63 {
+			ty, r = 2, 0
+		}
+		return around[ty][0][r], around[ty][1][r], around[ty][2][r]
+	}
+
+	next := new(tile)
+	for r := 0; r < 64; r++ {
+		var planes [8]uint64
+		for i, dr := range []int{-1, 0, 1} {
+			west, centre, east := word(r + dr)
+			planes[2*i] = centre<<1 | west>>63
+			planes[2*i+1] = centre>>1 | east<<63
+			if dr != 0 {
+				planes[6+i/2] = centre
+			}
+		}
+		next[r] = rule.nextWord(planes, around[1][1][r])
+	}
+	return next
+}
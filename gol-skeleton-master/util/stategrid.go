@@ -0,0 +1,78 @@
+package util
+
+// StateGrid is a world under a Generations rule, with the state of each cell in a byte: 0 dead,
+// 1 alive, and 2 up to the rule's States-1 for dying cells.
+type StateGrid struct {
+	Width  int
+	Height int
+	Cells  []uint8
+}
+
+// NewStateGrid makes a width x height grid of dead cells.
+func NewStateGrid(width, height int) *StateGrid {
+	return &StateGrid{Width: width, Height: height, Cells: make([]uint8, width*height)}
+}
+
+// Get returns the state of the cell at (x, y).
+func (g *StateGrid) Get(x, y int) uint8 {
+	return g.Cells[y*g.Width+x]
+}
+
+// Set changes the state of the cell at (x, y).
+func (g *StateGrid) Set(x, y int, state uint8) {
+	g.Cells[y*g.Width+x] = state
+}
+
+// Row returns the states of row y. Changes to it change the grid.
+func (g *StateGrid) Row(y int) []uint8 {
+	return g.Cells[y*g.Width : (y+1)*g.Width]
+}
+
+// Alive returns the alive cells, which are the ones that count as neighbours, packed into bits.
+func (g *StateGrid) Alive() *BitGrid {
+	alive := NewBitGrid(g.Width, g.Height)
+	for y := 0; y < g.Height; y++ {
+		row := alive.Row(y)
+		for x, state := range g.Row(y) {
+			if state == 1 {
+				row[x/64] |= 1 << uint(x%64)
+			}
+		}
+	}
+	return alive
+}
+
+// ChangedCells lists the cells whose state differs between g and next, with their new states.
+func (g *StateGrid) ChangedCells(next *StateGrid, startY, endY int) ([]Cell, []uint8) {
+	cells := []Cell{}
+	var states []uint8
+	for y := startY; y < endY; y++ {
+		row, nextRow := g.Row(y), next.Row(y)
+		for x := range row {
+			if row[x] != nextRow[x] {
+				cells = append(cells, Cell{X: x, Y: y})
+				states = append(states, nextRow[x])
+			}
+		}
+	}
+	return cells, states
+}
+
+// NextStates works out the next states of a row under a Generations rule. born holds the cells
+// of the row that are alive next turn as if every dying cell were dead, as worked out by NextRow
+// from the alive cells alone.
+func (r Rule) NextStates(next, states []uint8, born []uint64) {
+	for x, state := range states {
+		aliveNext := born[x/64]&(1<<uint(x%64)) != 0
+		switch {
+		case state == 0 && aliveNext, state == 1 && aliveNext:
+			next[x] = 1
+		case state == 0:
+			next[x] = 0
+		case int(state)+1 < r.States:
+			next[x] = state + 1
+		default:
+			next[x] = 0
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Topology says how the edges of the world join up.
+type Topology int
+
+const (
+	// Torus joins the west edge to the east and the top to the bottom.
+	Torus Topology = iota
+	// Plane joins nothing, so every cell beyond the edges is dead.
+	Plane
+	// Cylinder joins the west edge to the east, with dead cells above and below.
+	Cylinder
+	// KleinBottle joins the west edge to the east, and the top to the bottom with a twist, so
+	// that leaving the top at column x comes back in at the bottom at column width-1-x.
+	KleinBottle
+	// CrossSurface joins both pairs of edges with a twist. A neighbour that is beyond two edges
+	// at once, past a corner, is taken as dead.
+	CrossSurface
+)
+
+var topologyNames = []string{"torus", "plane", "cylinder", "klein", "cross"}
+
+// ParseTopology reads the name of a topology: torus, plane, cylinder, klein or cross.
+func ParseTopology(s string) (Topology, error) {
+	for i, name := range topologyNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return Topology(i), nil
+		}
+	}
+	return Torus, fmt.Errorf("unknown topology %q, expected one of %v", s, strings.Join(topologyNames, ", "))
+}
+
+func (t Topology) String() string {
+	if t < 0 || int(t) >= len(topologyNames) {
+		return fmt.Sprintf("Topology(%d)", int(t))
+	}
+	return topologyNames[t]
+}
+
+// Set parses the name of a topology into t, so a Topology can be given as a command line flag.
+func (t *Topology) Set(s string) error {
+	topology, err := ParseTopology(s)
+	if err != nil {
+		return err
+	}
+	*t = topology
+	return nil
+}
+
+// WrapsX reports whether the west and east edges join up without a twist, so that the rows
+// of the world can be stepped on their own.
+func (t Topology) WrapsX() bool {
+	return t == Torus || t == Cylinder || t == KleinBottle
+}
+
+// TwistsX reports whether the west and east edges join up with a twist, so that the cells on
+// those edges have neighbours on other rows.
+func (t Topology) TwistsX() bool {
+	return t == CrossSurface
+}
+
+// Locate finds the cell of a width x height world that (x, y) refers to, where (x, y) may be up
+// to one cell beyond the edges. It reports false if there is no such cell, and the neighbour
+// is dead.
+func (t Topology) Locate(x, y, width, height int) (int, int, bool) {
+	offX := x < 0 || x >= width
+	offY := y < 0 || y >= height
+	switch t {
+	case Plane:
+		return x, y, !offX && !offY
+	case Cylinder:
+		return wrap(x, width), y, !offY
+	case KleinBottle:
+		if offY {
+			x, y = width-1-x, wrap(y, height)
+		}
+		return wrap(x, width), y, true
+	case CrossSurface:
+		if offX && offY {
+			return x, y, false
+		}
+		if offY {
+			x, y = width-1-x, wrap(y, height)
+		}
+		if offX {
+			x, y = wrap(x, width), height-1-y
+		}
+		return x, y, true
+	default:
+		return wrap(x, width), wrap(y, height), true
+	}
+}
+
+func wrap(i, n int) int {
+	return (i%n + n) % n
+}
+
+// AcrossY returns row as seen from the other side of the top or bottom edge it lies on, or nil
+// if nothing can be seen across that edge.
+func (t Topology) AcrossY(row []uint64, width int) []uint64 {
+	switch t {
+	case Plane, Cylinder:
+		return nil
+	case KleinBottle, CrossSurface:
+		return ReverseRow(row, width)
+	default:
+		return row
+	}
+}
+
+// NextRows computes rows startY up to endY of the next turn of world into next, under the rule
+// and with the edges joined up by the topology.
+func (t Topology) NextRows(rule Rule, next, world *BitGrid, startY, endY int) {
+	height := world.Height
+	empty := make([]uint64, WordsPerRow(world.Width))
+	// row returns the row at y as seen from inside the world, which may be beyond the edges.
+	row := func(y int) []uint64 {
+		if y >= 0 && y < height {
+			return world.Row(y)
+		}
+		if across := t.AcrossY(world.Row(wrap(y, height)), world.Width); across != nil {
+			return across
+		}
+		return empty
+	}
+
+	for y := startY; y < endY; y++ {
+		rule.NextRow(next.Row(y), row(y-1), row(y), row(y+1), world.Width, t.WrapsX())
+		if !t.TwistsX() {
+			continue
+		}
+		// The cells on the west and east edges see neighbours on other rows, so they are worked out one by one.
+		for _, x := range []int{0, world.Width - 1} {
+			neighbours := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if nx, ny, ok := t.Locate(x+dx, y+dy, world.Width, height); ok && (dx != 0 || dy != 0) && world.Get(nx, ny) {
+						neighbours++
+					}
+				}
+			}
+			next.Set(x, y, rule.Next(world.Get(x, y), neighbours))
+		}
+	}
+}